@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"mini-mixlr/mixlr"
+)
+
+// Everything the process is configured with, read from the environment in
+// one pass at startup. Invalid values are collected and reported together,
+// so misconfiguration shows up at boot rather than mid-show.
+type Config struct {
+	// PORT, default 8080
+	Port int
+	// CONFIG_DUMP=true logs the loaded configuration, secrets redacted
+	Dump bool
+	// TURN_SECRET_FILE: read for the TURN secret in place of TURN_SECRET,
+	// and again on SIGHUP so the secret can rotate without a restart
+	TURNSecretFile string
+
+	Server mixlr.Options
+}
+
+// Reads env vars, remembering every parse error instead of stopping at the
+// first
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) fail(name, v string, err error) {
+	e.errs = append(e.errs, fmt.Errorf("%s=%q: %w", name, v, err))
+}
+
+func (e *envReader) int(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.fail(name, v, errors.New("not an integer"))
+	}
+	return n
+}
+
+func (e *envReader) duration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(name, v, errors.New("not a duration like 30s or 5m"))
+	}
+	return d
+}
+
+func (e *envReader) bool(name string) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(name, v, errors.New("not true or false"))
+	}
+	return b
+}
+
+// Comma-separated integers; unset gives nil
+func (e *envReader) intList(name string) []int {
+	var list []int
+	for _, v := range envList(name) {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			e.fail(name, v, errors.New("not an integer"))
+			continue
+		}
+		list = append(list, n)
+	}
+	return list
+}
+
+// Comma-separated list; blanks are dropped
+func envList(name string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// The TURN secret from a file, surrounding whitespace dropped
+func readTURNSecret(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("TURN secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// Read and validate the whole configuration. The error lists every
+// problem found.
+func loadConfig() (Config, error) {
+	var e envReader
+	cfg := Config{
+		Port:           e.int("PORT", 8080),
+		Dump:           e.bool("CONFIG_DUMP"),
+		TURNSecretFile: os.Getenv("TURN_SECRET_FILE"),
+	}
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		e.fail("PORT", strconv.Itoa(cfg.Port), errors.New("not a port number"))
+	}
+
+	trustedProxies, err := mixlr.ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		e.errs = append(e.errs, err)
+	}
+
+	quality, err := mixlr.ParseQualityThresholds(
+		os.Getenv("QUALITY_LOSS"), os.Getenv("QUALITY_JITTER"), os.Getenv("QUALITY_RTT"))
+	if err != nil {
+		e.errs = append(e.errs, err)
+	}
+
+	// JWT auth for /create and /join; unset leaves them open
+	var auth mixlr.Authenticator
+	if keyFile := os.Getenv("AUTH_JWT_PUBLIC_KEY"); keyFile != "" {
+		if auth, err = mixlr.NewJWTAuthenticator(keyFile, os.Getenv("AUTH_JWT_ISSUER"), os.Getenv("AUTH_JWT_AUDIENCE")); err != nil {
+			e.errs = append(e.errs, err)
+		}
+	}
+
+	// Captcha check for listener joins; unset leaves them open
+	var verifier mixlr.ListenerVerifier
+	if secret := os.Getenv("CAPTCHA_SECRET"); secret != "" {
+		if verifier, err = mixlr.NewCaptchaVerifier(os.Getenv("CAPTCHA_VERIFY_URL"), secret); err != nil {
+			e.errs = append(e.errs, err)
+		}
+	}
+
+	turnSecret := os.Getenv("TURN_SECRET")
+	if cfg.TURNSecretFile != "" {
+		if turnSecret, err = readTURNSecret(cfg.TURNSecretFile); err != nil {
+			e.errs = append(e.errs, err)
+		}
+	}
+
+	// Pacing is off unless PACING=true; PACING_GAP tunes the spacing
+	var pacingGap time.Duration
+	if e.bool("PACING") {
+		pacingGap = e.duration("PACING_GAP", 5*time.Millisecond)
+	}
+
+	cfg.Server = mixlr.Options{
+		TrustedProxies:      trustedProxies,
+		AdminToken:          os.Getenv("ADMIN_TOKEN"),
+		RecordingDir:        os.Getenv("RECORDING_DIR"),
+		RecordingGrace:      e.duration("RECORDING_GRACE", 30*time.Second),
+		RootRedirect:        os.Getenv("ROOT_REDIRECT"),
+		Region:              os.Getenv("REGION"),
+		RegionURL:           strings.TrimSuffix(os.Getenv("REGION_URL"), "/"),
+		BandwidthEstimation: e.bool("BANDWIDTH_ESTIMATION"),
+		ICELite:             e.bool("ICE_LITE"),
+		NoSTUN:              e.bool("NO_STUN"),
+		NoTrickleICE:        e.bool("NO_TRICKLE_ICE"),
+		RenegotiationLimit:  e.int("RENEGOTIATION_LIMIT", 10),
+		RenegotiationWindow: e.duration("RENEGOTIATION_WINDOW", time.Minute),
+		TURNURLs:            envList("TURN_URLS"),
+		TURNSecret:          turnSecret,
+		TURNTTL:             e.duration("TURN_TTL", 24*time.Hour),
+		MaxRoomBandwidth:    e.int("MAX_ROOM_BANDWIDTH", 0),
+		MaxBroadcastBitrate: e.int("MAX_BROADCAST_BITRATE", 0),
+		MaxListenersPerIP:   e.int("MAX_LISTENERS_PER_IP", 20),
+		MessageRate:         e.int("MESSAGE_RATE", 20),
+		MessageBurst:        e.int("MESSAGE_BURST", 100),
+		DTLSCertFile:        os.Getenv("DTLS_CERT_FILE"),
+		DTLSRole:            os.Getenv("DTLS_ROLE"),
+		OpusPayloadType:     e.int("OPUS_PAYLOAD_TYPE", 0),
+		PCCreateRetries:     e.int("PC_CREATE_RETRIES", 2),
+		PCCreateRetryDelay:  e.duration("PC_CREATE_RETRY_DELAY", 100*time.Millisecond),
+		Quality:             &quality,
+		ReattachWindow:      e.duration("REATTACH_WINDOW", 30*time.Second),
+		HandshakeTimeout:    e.duration("HANDSHAKE_TIMEOUT", 30*time.Second),
+		PeerCloseTimeout:    e.duration("PEER_CLOSE_TIMEOUT", 5*time.Second),
+		MaxNegotiations:     e.int("MAX_NEGOTIATIONS", 4*runtime.NumCPU()),
+		FanoutWorkers:       e.int("FANOUT_WORKERS", 1),
+		FanoutThreshold:     e.int("FANOUT_THRESHOLD", 0),
+		MaxConnections:      e.int("MAX_CONNECTIONS", 0),
+		MaxGoroutines:       e.int("MAX_GOROUTINES", 0),
+		FirstTrackTimeout:   e.duration("FIRST_TRACK_TIMEOUT", 10*time.Second),
+		PacingGap:           pacingGap,
+		SeedFile:            os.Getenv("ROOMS_SEED_FILE"),
+		TokenSecret:         os.Getenv("TOKEN_SECRET"),
+		CodecPreferences:    envList("CODEC_PREFERENCES"),
+		ReservationWindow:   e.duration("RESERVATION_WINDOW", 24*time.Hour),
+		Authenticator:       auth,
+		MaxRoomsPerUser:     e.int("MAX_ROOMS_PER_USER", 0),
+		OutboundHosts:       envList("OUTBOUND_HOSTS"),
+		RoomIdleTimeout:     e.duration("ROOM_IDLE_TIMEOUT", 0),
+		MaxLobbyRooms:       e.int("MAX_LOBBY_ROOMS", 0),
+		ListenerMilestones:  e.intList("LISTENER_MILESTONES"),
+		ListenerVerifier:    verifier,
+		DuplicateListeners:  os.Getenv("DUPLICATE_LISTENERS"),
+		IdempotencyTTL:      e.duration("IDEMPOTENCY_TTL", 10*time.Minute),
+		PrimePackets:        e.int("PRIME_PACKETS", 0),
+		PreconnectBuffer:    e.int("PRECONNECT_BUFFER", 0),
+	}
+
+	// Only worth checking once everything parsed, or it repeats the
+	// parse errors as range errors
+	if len(e.errs) == 0 {
+		if err := cfg.Server.Validate(); err != nil {
+			e.errs = append(e.errs, err)
+		}
+	}
+	return cfg, errors.Join(e.errs...)
+}
+
+// Option fields never logged as is
+var secretOptions = map[string]bool{
+	"AdminToken":  true,
+	"TURNSecret":  true,
+	"TokenSecret": true,
+}
+
+// Log the configuration, one option per line, with secrets shown only as
+// set or unset
+func (cfg Config) dump() {
+	log.Printf("Config: Port=%d", cfg.Port)
+	v := reflect.ValueOf(cfg.Server)
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		field := v.Field(i)
+		var shown string
+		switch {
+		case secretOptions[name]:
+			shown = "<unset>"
+			if !field.IsZero() {
+				shown = "<redacted>"
+			}
+		case field.Kind() == reflect.Func || field.Kind() == reflect.Interface:
+			shown = "<unset>"
+			if !field.IsNil() {
+				shown = fmt.Sprintf("<%T>", field.Interface())
+			}
+		case field.Kind() == reflect.Pointer:
+			shown = "<unset>"
+			if !field.IsNil() {
+				shown = fmt.Sprintf("%+v", field.Elem().Interface())
+			}
+		default:
+			shown = fmt.Sprintf("%v", field.Interface())
+		}
+		log.Printf("Config: %s=%s", name, shown)
+	}
+}
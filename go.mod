@@ -4,5 +4,8 @@ go 1.22
 
 require (
     github.com/gorilla/websocket v1.5.3
+    github.com/pion/interceptor v0.1.37
+    github.com/pion/rtcp v1.2.15
+    github.com/pion/rtp v1.8.11
     github.com/pion/webrtc/v4 v4.0.9
 )
@@ -0,0 +1,249 @@
+package mixlr
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v4"
+)
+
+// Opus as the room's listeners receive it. Stereo rooms advertise
+// stereo=1 so browsers encode and play back both channels.
+func opusCapability(stereo bool) webrtc.RTPCodecCapability {
+	fmtp := "minptime=10;useinbandfec=1"
+	if stereo {
+		fmtp += ";stereo=1;sprop-stereo=1"
+	}
+	return webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   48000,
+		Channels:    2,
+		SDPFmtpLine: fmtp,
+	}
+}
+
+// Pion's usual Opus payload type
+const defaultOpusPayloadType = 111
+
+// Options.OpusPayloadType resolved: 0 means the default, anything else
+// must be in the dynamic range
+func opusPayloadType(pt int) (webrtc.PayloadType, error) {
+	if pt == 0 {
+		return defaultOpusPayloadType, nil
+	}
+	if pt < 96 || pt > 127 {
+		return 0, fmt.Errorf("invalid Opus payload type %d (want 96-127)", pt)
+	}
+	return webrtc.PayloadType(pt), nil
+}
+
+// The codecs registered with the media engine. Only Opus is forwarded, so
+// it's the only one we negotiate.
+func (s *Server) audioCodecs(stereo bool) ([]webrtc.RTPCodecParameters, error) {
+	pt, err := opusPayloadType(s.opts.OpusPayloadType)
+	if err != nil {
+		return nil, err
+	}
+	return []webrtc.RTPCodecParameters{{
+		RTPCodecCapability: opusCapability(stereo),
+		PayloadType:        pt,
+	}}, nil
+}
+
+// Options.CodecPreferences resolved against the registered codecs: those
+// listed come first, in the given order, then the rest. Nil if no
+// preferences are set; an error if one names a codec we don't register.
+func (s *Server) codecPreferences(stereo bool) ([]webrtc.RTPCodecParameters, error) {
+	if len(s.opts.CodecPreferences) == 0 {
+		return nil, nil
+	}
+	codecs, err := s.audioCodecs(stereo)
+	if err != nil {
+		return nil, err
+	}
+
+	var preferred []webrtc.RTPCodecParameters
+	used := make([]bool, len(codecs))
+	for _, mime := range s.opts.CodecPreferences {
+		found := false
+		for i, codec := range codecs {
+			if strings.EqualFold(codec.MimeType, mime) {
+				found = true
+				if !used[i] {
+					preferred = append(preferred, codec)
+					used[i] = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("codec preference %q is not a registered codec (have %s)", mime, mimeTypes(codecs))
+		}
+	}
+	for i, codec := range codecs {
+		if !used[i] {
+			preferred = append(preferred, codec)
+		}
+	}
+	return preferred, nil
+}
+
+func mimeTypes(codecs []webrtc.RTPCodecParameters) string {
+	names := make([]string, len(codecs))
+	for i, codec := range codecs {
+		names[i] = codec.MimeType
+	}
+	return strings.Join(names, ", ")
+}
+
+// Apply the codec preferences to the connection's audio transceivers, so
+// our answer (or offer) lists codecs in that order. Call once they're set
+// up and before negotiating.
+func (s *Server) preferCodecs(pc *webrtc.PeerConnection, stereo bool) error {
+	prefs := s.codecPrefs
+	if stereo {
+		prefs = s.stereoCodecPrefs
+	}
+	if prefs == nil {
+		return nil
+	}
+	for _, t := range pc.GetTransceivers() {
+		if t.Kind() != webrtc.RTPCodecTypeAudio {
+			continue
+		}
+		if err := t.SetCodecPreferences(prefs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The Opus fmtp lives in the media engine, so mono and stereo rooms each
+// get their own API
+func (s *Server) newAPI(stereo bool) (*webrtc.API, error) {
+	codecs, err := s.audioCodecs(stereo)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &webrtc.MediaEngine{}
+	for _, codec := range codecs {
+		if err := m.RegisterCodec(codec, webrtc.RTPCodecTypeAudio); err != nil {
+			return nil, err
+		}
+	}
+
+	i := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+		return nil, err
+	}
+
+	if s.opts.BandwidthEstimation {
+		// Pacing is left to the browser's jitter buffer; we only want the estimate
+		factory, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+			return gcc.NewSendSideBWE(gcc.SendSideBWEPacer(gcc.NewNoOpPacer()))
+		})
+		if err != nil {
+			return nil, err
+		}
+		factory.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+			s.newEstimator = estimator
+		})
+		i.Add(factory)
+		if err := webrtc.ConfigureTWCCHeaderExtensionSender(m, i); err != nil {
+			return nil, err
+		}
+	}
+
+	// Last, so paced packets are what the transport actually sends
+	if s.opts.PacingGap > 0 {
+		i.Add(&pacerFactory{gap: s.opts.PacingGap})
+	}
+	// Outermost, so nothing below sees packets for an unconnected peer
+	i.Add(&gateFactory{s: s})
+
+	se := webrtc.SettingEngine{}
+	se.SetLite(s.opts.ICELite)
+	role, err := dtlsRole(s.opts.DTLSRole)
+	if err != nil {
+		return nil, err
+	}
+	if role != webrtc.DTLSRoleAuto {
+		if err := se.SetAnsweringDTLSRole(role); err != nil {
+			return nil, err
+		}
+	}
+
+	return webrtc.NewAPI(
+		webrtc.WithMediaEngine(m),
+		webrtc.WithInterceptorRegistry(i),
+		webrtc.WithSettingEngine(se),
+	), nil
+}
+
+// Per-connection state from the API's interceptors
+type pcHooks struct {
+	// nil unless bandwidth estimation is enabled
+	estimator cc.BandwidthEstimator
+	// Open once the connection is up (see gate.go)
+	gate *sendGate
+}
+
+// Creates a peer connection on the shared API for the room's channel layout
+func (s *Server) newPeerConnection(config webrtc.Configuration, stereo bool) (*webrtc.PeerConnection, pcHooks, error) {
+	api := s.api
+	if stereo {
+		api = s.stereoAPI
+	}
+
+	config.Certificates = []webrtc.Certificate{*s.certificate.Load()}
+
+	s.pcCreateMu.Lock()
+	defer s.pcCreateMu.Unlock()
+
+	s.newEstimator, s.newGate = nil, nil
+	pc, err := api.NewPeerConnection(config)
+	if err != nil {
+		return nil, pcHooks{}, err
+	}
+	return pc, pcHooks{estimator: s.newEstimator, gate: s.newGate}, nil
+}
+
+// newPeerConnection with up to PCCreateRetries retries, doubling the delay
+// from PCCreateRetryDelay each time, to ride out transient failures under load
+func (s *Server) newPeerConnectionRetry(config webrtc.Configuration, stereo bool) (*webrtc.PeerConnection, pcHooks, error) {
+	delay := s.opts.PCCreateRetryDelay
+	for attempt := 0; ; attempt++ {
+		pc, hooks, err := s.newPeerConnection(config, stereo)
+		if err == nil || attempt >= s.opts.PCCreateRetries {
+			return pc, hooks, err
+		}
+		log.Printf("PeerConnection error (retrying in %s): %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Close pc, giving up after PeerCloseTimeout. Pion's Close can block on a
+// wedged transport; a close that times out is left to finish in the
+// background so teardown and Shutdown stay bounded. who is for the log.
+func (s *Server) closePeer(pc *webrtc.PeerConnection, who string) {
+	if s.opts.PeerCloseTimeout <= 0 {
+		pc.Close()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pc.Close()
+	}()
+	select {
+	case <-done:
+	case <-time.After(s.opts.PeerCloseTimeout):
+		log.Printf("Closing PeerConnection for %s timed out after %s", who, s.opts.PeerCloseTimeout)
+	}
+}
@@ -0,0 +1,199 @@
+package mixlr
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Who a request is from, as established by an Authenticator
+type Identity struct {
+	Subject string
+	Claims  map[string]any
+}
+
+// Checks requests to /create and /join before anything else happens. An
+// error rejects the request with 401. Options.Authenticator nil leaves
+// both open, as before.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// Run the configured Authenticator, writing the 401 itself on failure.
+// The identity is nil when no Authenticator is set.
+func (s *Server) authenticate(w http.ResponseWriter, r *http.Request) (*Identity, bool) {
+	if s.opts.Authenticator == nil {
+		return nil, true
+	}
+	id, err := s.opts.Authenticator.Authenticate(r)
+	if err != nil {
+		log.Printf("Authentication failed for %s: %v", s.clientIP(r), err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return id, true
+}
+
+// For log lines: the identity's subject, or "anonymous"
+func (id *Identity) String() string {
+	if id == nil || id.Subject == "" {
+		return "anonymous"
+	}
+	return id.Subject
+}
+
+// Reference Authenticator for JWTs signed by an identity provider. The
+// token comes from "Authorization: Bearer <jwt>" or, since browsers can't
+// set headers on a WebSocket, an access_token query parameter. RS256,
+// ES256 and EdDSA are accepted, matching the public key's type; exp and
+// nbf are enforced, and iss/aud when configured.
+type JWTAuthenticator struct {
+	key      crypto.PublicKey
+	issuer   string
+	audience string
+}
+
+// Load the provider's public key from a PEM file (PKIX "PUBLIC KEY" or a
+// certificate). Empty issuer or audience skips that check.
+func NewJWTAuthenticator(keyFile, issuer, audience string) (*JWTAuthenticator, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("JWT key %s: no PEM block", keyFile)
+	}
+
+	var key crypto.PublicKey
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("JWT key %s: %w", keyFile, err)
+		}
+		key = cert.PublicKey
+	default:
+		if key, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("JWT key %s: %w", keyFile, err)
+		}
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey, ed25519.PublicKey:
+	default:
+		return nil, fmt.Errorf("JWT key %s: unsupported key type %T", keyFile, key)
+	}
+	return &JWTAuthenticator{key: key, issuer: issuer, audience: audience}, nil
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("access_token")
+	}
+	if token == "" {
+		return nil, errors.New("no token")
+	}
+	claims, err := a.verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sub, _ := claims["sub"].(string)
+	return &Identity{Subject: sub, Claims: claims}, nil
+}
+
+func (a *JWTAuthenticator) verify(token string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("token signature is not base64url")
+	}
+	if err := a.checkSignature(header.Alg, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("token claims: %w", err)
+	}
+	if exp, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("token expired or has no exp")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("token not valid yet")
+	}
+	if a.issuer != "" && claims["iss"] != a.issuer {
+		return nil, errors.New("wrong issuer")
+	}
+	if a.audience != "" && !hasAudience(claims["aud"], a.audience) {
+		return nil, errors.New("wrong audience")
+	}
+	return claims, nil
+}
+
+func (a *JWTAuthenticator) checkSignature(alg, signed string, sig []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+	valid := false
+	switch key := a.key.(type) {
+	case *rsa.PublicKey:
+		valid = alg == "RS256" && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		// JWS ECDSA signatures are r||s, not ASN.1
+		if alg == "ES256" && len(sig) == 64 {
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			valid = ecdsa.Verify(key, digest[:], r, s)
+		}
+	case ed25519.PublicKey:
+		valid = alg == "EdDSA" && ed25519.Verify(key, []byte(signed), sig)
+	}
+	if !valid {
+		return fmt.Errorf("bad %s signature", alg)
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// aud may be a single string or a list
+func hasAudience(aud any, want string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == want
+	case []any:
+		for _, a := range aud {
+			if a == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package mixlr
+
+import (
+	"time"
+
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const rembInterval = time.Second
+
+// Drain RTCP from a listener's sender. This must run for the interceptors
+// (NACK, reports, TWCC) to see feedback. With estimation on we also record
+// any REMB the listener's browser sends and the GCC estimate for its link,
+// and with quality scoring on we score its reception reports.
+func (s *Server) readListenerRTCP(room *Room, p *peer, sender *webrtc.RTPSender, estimator cc.BandwidthEstimator) {
+	pc := p.pc
+	defer recoverPanic("RTCP from "+p.id+" in room "+room.Name, func() { s.closePeer(pc, p.id) })
+	if estimator != nil {
+		estimator.OnTargetBitrateChange(func(bitrate int) {
+			p.room.Load().setListenerBitrate(pc, bitrate)
+		})
+	}
+
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		for _, pkt := range packets {
+			switch pkt := pkt.(type) {
+			case *rtcp.ReceiverEstimatedMaximumBitrate:
+				if s.opts.BandwidthEstimation {
+					p.room.Load().setListenerBitrate(pc, int(pkt.Bitrate))
+				}
+			case *rtcp.ReceiverReport:
+				if s.opts.Quality == nil || len(pkt.Reports) == 0 {
+					continue
+				}
+				loss, jitter, rtt := reportStats(pkt.Reports[0], room.track.Codec().ClockRate, time.Now())
+				p.reportQuality(s.opts.Quality.score(loss, jitter, rtt))
+			}
+		}
+	}
+}
+
+func (room *Room) setListenerBitrate(pc *webrtc.PeerConnection, bitrate int) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.Listeners[pc] != nil {
+		room.listenerBitrates[pc] = bitrate
+	}
+}
+
+// The weakest listener's estimate, since every listener gets the same
+// encoding. 0 means no listener has reported yet.
+func (room *Room) aggregateBitrate() int {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	lowest := 0
+	for _, bitrate := range room.listenerBitrates {
+		if lowest == 0 || bitrate < lowest {
+			lowest = bitrate
+		}
+	}
+	return lowest
+}
+
+// Periodically push the combined listener estimate to the broadcaster as a
+// REMB for its incoming track, until the broadcaster goes away.
+func sendBroadcasterREMB(room *Room, pc *webrtc.PeerConnection, ssrc webrtc.SSRC) {
+	defer recoverPanic("REMB for room "+room.Name, nil)
+	ticker := time.NewTicker(rembInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if pc.ConnectionState() == webrtc.PeerConnectionStateClosed {
+			return
+		}
+		bitrate := room.aggregateBitrate()
+		if bitrate == 0 {
+			continue
+		}
+		err := pc.WriteRTCP([]rtcp.Packet{&rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: float32(bitrate),
+			SSRCs:   []uint32{uint32(ssrc)},
+		}})
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package mixlr
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// Compact binary signaling, selected with ?proto=binary. Each WebSocket
+// binary message is one frame: a type byte followed by uvarint
+// length-prefixed fields.
+//
+//	offer/answer: sdp, seq+1 (uvarint, 0 = absent; may be left off)
+//	candidate:    candidate, sdpMid, sdpMLineIndex+1 (uvarint, 0 = absent)
+//	json:         a JSON message with no binary form (errors, events)
+//
+// Frames are translated to and from the JSON messages handleSignaling
+// already speaks, so both protocols share one code path.
+const (
+	frameJSON      byte = 0
+	frameOffer     byte = 1
+	frameAnswer    byte = 2
+	frameCandidate byte = 3
+)
+
+var errBadFrame = errors.New("malformed binary signaling frame")
+
+// Turn an outgoing JSON message into a binary frame
+func encodeFrame(msg []byte) []byte {
+	var m struct {
+		Type          string          `json:"type"`
+		SDP           json.RawMessage `json:"sdp"`
+		Candidate     json.RawMessage `json:"candidate"`
+		SDPMid        *string         `json:"sdpMid"`
+		SDPMLineIndex *uint16         `json:"sdpMLineIndex"`
+		Seq           *uint32         `json:"seq"`
+	}
+	if json.Unmarshal(msg, &m) != nil {
+		return appendField([]byte{frameJSON}, msg)
+	}
+
+	switch m.Type {
+	case "offer", "answer":
+		var desc struct {
+			SDP string `json:"sdp"`
+		}
+		if json.Unmarshal(m.SDP, &desc) != nil {
+			break
+		}
+		frameType := frameOffer
+		if m.Type == "answer" {
+			frameType = frameAnswer
+		}
+		frame := appendField([]byte{frameType}, []byte(desc.SDP))
+		seq := uint64(0)
+		if m.Seq != nil {
+			seq = uint64(*m.Seq) + 1
+		}
+		return binary.AppendUvarint(frame, seq)
+
+	case "candidate":
+		var candidate string
+		if json.Unmarshal(m.Candidate, &candidate) != nil {
+			break
+		}
+		frame := appendField([]byte{frameCandidate}, []byte(candidate))
+		mid := ""
+		if m.SDPMid != nil {
+			mid = *m.SDPMid
+		}
+		frame = appendField(frame, []byte(mid))
+		index := uint64(0)
+		if m.SDPMLineIndex != nil {
+			index = uint64(*m.SDPMLineIndex) + 1
+		}
+		return binary.AppendUvarint(frame, index)
+	}
+
+	return appendField([]byte{frameJSON}, msg)
+}
+
+// Turn an incoming binary frame into the equivalent JSON message
+func decodeFrame(frame []byte) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, errBadFrame
+	}
+	frameType, rest := frame[0], frame[1:]
+
+	switch frameType {
+	case frameJSON:
+		msg, _, err := readField(rest)
+		return msg, err
+
+	case frameOffer, frameAnswer:
+		sdp, rest, err := readField(rest)
+		if err != nil {
+			return nil, err
+		}
+		sdpType := "offer"
+		if frameType == frameAnswer {
+			sdpType = "answer"
+		}
+		msg := map[string]any{
+			"type": sdpType,
+			"sdp":  map[string]string{"type": sdpType, "sdp": string(sdp)},
+		}
+		if len(rest) > 0 {
+			seq, n := binary.Uvarint(rest)
+			if n <= 0 || seq > 1<<32 {
+				return nil, errBadFrame
+			}
+			if seq > 0 {
+				msg["seq"] = seq - 1
+			}
+		}
+		return json.Marshal(msg)
+
+	case frameCandidate:
+		candidate, rest, err := readField(rest)
+		if err != nil {
+			return nil, err
+		}
+		mid, rest, err := readField(rest)
+		if err != nil {
+			return nil, err
+		}
+		index, n := binary.Uvarint(rest)
+		if n <= 0 || index > 1<<16 {
+			return nil, errBadFrame
+		}
+
+		init := map[string]any{"candidate": string(candidate)}
+		if len(mid) > 0 {
+			init["sdpMid"] = string(mid)
+		}
+		if index > 0 {
+			init["sdpMLineIndex"] = index - 1
+		}
+		return json.Marshal(map[string]any{"type": "candidate", "candidate": init})
+	}
+
+	return nil, errBadFrame
+}
+
+func appendField(frame, field []byte) []byte {
+	frame = binary.AppendUvarint(frame, uint64(len(field)))
+	return append(frame, field...)
+}
+
+func readField(b []byte) (field, rest []byte, err error) {
+	n, size := binary.Uvarint(b)
+	if size <= 0 || n > uint64(len(b)-size) {
+		return nil, nil, errBadFrame
+	}
+	end := size + int(n)
+	return b[size:end], b[end:], nil
+}
@@ -0,0 +1,66 @@
+package mixlr
+
+import (
+	"log"
+	"time"
+)
+
+// With Options.RoomIdleTimeout set, a room nobody has used for that
+// long is removed, freeing its ID and counting it off its creator's
+// MaxRoomsPerUser quota (see quota.go). A room is in use while it has a
+// broadcaster, a listener or a replay running. Reserved rooms still
+// waiting for their broadcaster are left to reservation.go, and seeded
+// rooms are kept.
+
+// How often rooms are checked: a quarter of the timeout, at most a minute
+func sweepInterval(timeout time.Duration) time.Duration {
+	return min(timeout/4, time.Minute)
+}
+
+// Remove abandoned rooms until shutdown
+func (s *Server) sweepRooms() {
+	ticker := time.NewTicker(sweepInterval(s.opts.RoomIdleTimeout))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case now := <-ticker.C:
+			s.removeAbandoned(now)
+		}
+	}
+}
+
+func (s *Server) removeAbandoned(now time.Time) {
+	s.roomsMu.Lock()
+	var removed []*Room
+	for _, room := range s.rooms {
+		if room.abandoned(now, s.opts.RoomIdleTimeout) {
+			s.removeRoom(room)
+			removed = append(removed, room)
+		}
+	}
+	s.roomsMu.Unlock()
+
+	for _, room := range removed {
+		log.Printf("Room %s removed after %s unused", room.Name, s.opts.RoomIdleTimeout)
+		room.publish(roomEvent{Type: eventRoomRemoved})
+	}
+}
+
+// Whether the room has gone unused for timeout, starting its clock if it
+// has only just become unused
+func (room *Room) abandoned(now time.Time, timeout time.Duration) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.seeded || !room.reservedUntil.IsZero() ||
+		room.Broadcaster != nil || len(room.Listeners) > 0 || room.replay != nil {
+		room.unusedSince = time.Time{}
+		return false
+	}
+	if room.unusedSince.IsZero() {
+		room.unusedSince = now
+	}
+	return now.Sub(room.unusedSince) >= timeout
+}
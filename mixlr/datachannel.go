@@ -0,0 +1,79 @@
+package mixlr
+
+import (
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// A broadcaster can open a data channel labelled "metadata" to push "now
+// playing" titles, cue points and the like. Every listener is given a
+// channel of the same label by the server, and each message is relayed to
+// all of them as is. Channels with other labels are left alone, so this
+// doesn't get mixed up with anything else a client may send.
+const metadataChannel = "metadata"
+
+// Relay the broadcaster's metadata channel to the room's listeners
+func (room *Room) relayMetadata(dc *webrtc.DataChannel) {
+	if dc.Label() != metadataChannel {
+		log.Printf("Ignoring data channel %q from broadcaster in room %s", dc.Label(), room.Name)
+		return
+	}
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		defer recoverPanic("metadata relay in room "+room.Name, nil)
+		room.mu.Lock()
+		room.lastMetadata = &msg
+		listeners := make([]*peer, 0, len(room.Listeners))
+		for _, p := range room.Listeners {
+			listeners = append(listeners, p)
+		}
+		room.mu.Unlock()
+
+		// Sends only queue on the SCTP association, but keep them out of
+		// the lock anyway
+		for _, p := range listeners {
+			if p.metadata != nil && p.metadata.ReadyState() == webrtc.DataChannelStateOpen {
+				sendMetadata(p.metadata, msg)
+			}
+		}
+	})
+}
+
+// Give a listener its metadata channel; must happen before the first offer.
+// Once it opens, the latest message is sent so late joiners see what's
+// playing.
+func (room *Room) openMetadata(p *peer) error {
+	dc, err := p.pc.CreateDataChannel(metadataChannel, nil)
+	if err != nil {
+		return err
+	}
+	dc.OnOpen(func() {
+		room.mu.RLock()
+		last := room.lastMetadata
+		room.mu.RUnlock()
+		if last != nil {
+			sendMetadata(dc, *last)
+		}
+	})
+	p.metadata = dc
+	return nil
+}
+
+// Forget the last message when the broadcaster leaves
+func (room *Room) clearMetadata() {
+	room.mu.Lock()
+	room.lastMetadata = nil
+	room.mu.Unlock()
+}
+
+func sendMetadata(dc *webrtc.DataChannel, msg webrtc.DataChannelMessage) {
+	var err error
+	if msg.IsString {
+		err = dc.SendText(string(msg.Data))
+	} else {
+		err = dc.Send(msg.Data)
+	}
+	if err != nil {
+		log.Println("Metadata send error:", err)
+	}
+}
@@ -0,0 +1,139 @@
+package mixlr
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// The DTLS certificate every peer connection presents. Pion otherwise
+// generates a fresh ECDSA key and certificate per connection, which adds
+// up on a busy server.
+//
+// With a path, the certificate is loaded from it, or generated and saved
+// there on first start so restarts keep the same fingerprint. The file is
+// in pion's own PEM layout (Certificate.PEM). Without a path it's
+// generated once per process.
+//
+// Pion refuses to create peer connections with an expired certificate, so
+// ours are made to last certValidity, one due to expire within
+// certRenewBefore is replaced on load, and renewCertificate checks again
+// every certCheckInterval while the server runs.
+func loadCertificate(path string) (*webrtc.Certificate, error) {
+	if path != "" {
+		pem, err := os.ReadFile(path)
+		if err == nil {
+			cert, err := webrtc.CertificateFromPEM(string(pem))
+			if err != nil {
+				return nil, fmt.Errorf("DTLS certificate %s: %w", path, err)
+			}
+			if !certificateExpiring(cert) {
+				return cert, nil
+			}
+			log.Printf("DTLS certificate %s expires %s, replacing it", path, cert.Expires().Format(time.RFC3339))
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	cert, err := generateCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		pem, err := cert.PEM()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(pem), 0o600); err != nil {
+			return nil, err
+		}
+		log.Printf("Generated DTLS certificate at %s", path)
+	}
+	return cert, nil
+}
+
+const (
+	// Lifetime of a generated certificate. webrtc.GenerateCertificate
+	// only gives a month.
+	certValidity = 365 * 24 * time.Hour
+	// Replaced once this close to expiry
+	certRenewBefore   = 30 * 24 * time.Hour
+	certCheckInterval = 24 * time.Hour
+)
+
+// A self-signed ECDSA certificate valid for certValidity
+func generateCertificate() (*webrtc.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	return webrtc.NewCertificate(key, x509.Certificate{
+		Issuer:       pkix.Name{CommonName: "mini-mixlr"},
+		Subject:      pkix.Name{CommonName: "mini-mixlr"},
+		SerialNumber: serial,
+		// A day's leeway for clients with slow clocks
+		NotBefore: now.Add(-24 * time.Hour),
+		NotAfter:  now.Add(certValidity),
+		Version:   2,
+	})
+}
+
+func certificateExpiring(cert *webrtc.Certificate) bool {
+	return time.Until(cert.Expires()) < certRenewBefore
+}
+
+// Replace the shared certificate before it expires, until shutdown.
+// Connections already up keep the one they negotiated with.
+func (s *Server) renewCertificate() {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-ticker.C:
+		}
+		if !certificateExpiring(s.certificate.Load()) {
+			continue
+		}
+		cert, err := loadCertificate(s.opts.DTLSCertFile)
+		if err != nil {
+			log.Println("DTLS certificate renewal:", err)
+			continue
+		}
+		s.certificate.Store(cert)
+		log.Printf("DTLS certificate renewed, valid until %s", cert.Expires().Format(time.RFC3339))
+	}
+}
+
+// Role the server takes when answering (the broadcaster's offers).
+// "" leaves pion's default (client).
+func dtlsRole(role string) (webrtc.DTLSRole, error) {
+	switch role {
+	case "":
+		return webrtc.DTLSRoleAuto, nil
+	case "client":
+		return webrtc.DTLSRoleClient, nil
+	case "server":
+		return webrtc.DTLSRoleServer, nil
+	}
+	return 0, fmt.Errorf("invalid DTLS role %q (want client or server)", role)
+}
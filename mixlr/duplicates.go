@@ -0,0 +1,64 @@
+package mixlr
+
+import (
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// Listener IDs are minted by the server, but with an Authenticator the
+// identity behind a connection comes from the client, and one identity can
+// end up listening twice: a reconnect that beat the old connection's
+// teardown, or a shared account. Options.DuplicateListeners decides what
+// happens. Anonymous listeners are never duplicates.
+const (
+	// The newcomer is turned away with duplicate_listener
+	DuplicateListenerReject = "reject"
+	// The old connection is sent {"type":"replaced"} and closed
+	DuplicateListenerReplace = "replace"
+)
+
+// Another listener in the room with p's identity, if any. Caller must hold
+// room.mu.
+func (room *Room) duplicateOf(p *peer) *peer {
+	if p.identity == nil {
+		return nil
+	}
+	for _, other := range room.Listeners {
+		if other != p && other.identity != nil && other.identity.Subject == p.identity.Subject {
+			return other
+		}
+	}
+	return nil
+}
+
+// Apply the duplicate policy to a joining listener, returning an error
+// code if it's turned away, or the listener it replaces. A replaced
+// listener leaves the room here, before its connection finishes closing,
+// so it doesn't count against capacity; the caller tells it with
+// sendReplaced once room.mu is released. Caller must hold room.mu.
+func (room *Room) claimIdentity(p *peer) (string, *peer) {
+	if room.duplicates == "" {
+		return "", nil
+	}
+	old := room.duplicateOf(p)
+	if old == nil {
+		return "", nil
+	}
+	if room.duplicates == DuplicateListenerReject {
+		log.Printf("Rejected duplicate listener %s for %s in room %s", p.id, p.identity, room.Name)
+		return codeDuplicateListener, nil
+	}
+
+	log.Printf("Listener %s for %s in room %s replaced by %s", old.id, old.identity, room.Name, p.id)
+	room.dropListener(old.pc)
+	return "", old
+}
+
+// Tell a listener it was replaced and close its socket, which also rules
+// out the old session reattaching. Must not hold room.mu: a stalled
+// socket would hold up the room.
+func (p *peer) sendReplaced() {
+	p.ws.WriteJSON(map[string]string{"type": "replaced"})
+	p.ws.CloseWith(websocket.CloseNormalClosure, "Replaced by a newer connection")
+}
@@ -0,0 +1,72 @@
+package mixlr
+
+import (
+	"sync"
+	"time"
+)
+
+// Opus rates assumed for a room until its broadcaster's real rate is known
+const (
+	nominalMonoBitrate   = 64_000
+	nominalStereoBitrate = 128_000
+)
+
+// Incoming broadcaster bitrate, measured over roughly one-second windows
+type bitrateMeter struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	bytes       int
+	bitrate     int
+	measuredAt  time.Time
+}
+
+func (m *bitrateMeter) add(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if m.windowStart.IsZero() {
+		m.windowStart = now
+	}
+	m.bytes += n
+	if elapsed := now.Sub(m.windowStart); elapsed >= time.Second {
+		m.bitrate = int(float64(m.bytes*8) / elapsed.Seconds())
+		m.measuredAt = now
+		m.windowStart = now
+		m.bytes = 0
+	}
+}
+
+// Latest measurement, or 0 if nothing has arrived lately
+func (m *bitrateMeter) rate() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if time.Since(m.measuredAt) > 3*time.Second {
+		return 0
+	}
+	return m.bitrate
+}
+
+// Bits per second sent to each listener: the measured broadcast rate,
+// falling back to the nominal Opus rate while nothing is being sent
+func (room *Room) streamBitrate() int {
+	if rate := room.ingress.rate(); rate > 0 {
+		return rate
+	}
+	if room.Stereo {
+		return nominalStereoBitrate
+	}
+	return nominalMonoBitrate
+}
+
+// Estimated egress with the given number of listeners
+func (room *Room) egress(listeners int) int {
+	return listeners * room.streamBitrate()
+}
+
+// Whether one more listener would push the room over MaxBandwidth.
+// Caller must hold room.mu.
+func (room *Room) overBandwidth() bool {
+	return room.MaxBandwidth > 0 && room.egress(len(room.Listeners)+1) > room.MaxBandwidth
+}
@@ -0,0 +1,77 @@
+package mixlr
+
+import "github.com/gorilla/websocket"
+
+// Stable error codes sent to clients as {"type":"error","code":...}.
+// Clients should switch on the code; the message is for humans.
+const (
+	codeShuttingDown       = "shutting_down"
+	codeBroadcasterExists  = "broadcaster_exists"
+	codeRoomFull           = "room_full"
+	codeRenegotiationFlood = "renegotiation_flood"
+	codeHandshakeTimeout   = "handshake_timeout"
+	codeRateLimited        = "rate_limited"
+	codeTooManyConnections = "too_many_connections"
+	codePCCreateFailed     = "pc_create_failed"
+	codeBandwidthExceeded  = "room_bandwidth_exceeded"
+	codeInvalidName        = "invalid_name"
+	codeInvalidReport      = "invalid_report"
+	// An offer from a listener or an answer from a broadcaster; the error
+	// also carries "expected" (see sendUnexpected)
+	codeUnexpectedMessage = "unexpected_message"
+	// An offer or answer from an earlier negotiation (see staleSDP)
+	codeStaleSDP = "stale_sdp"
+	// A migrate the server couldn't carry out; room_full or
+	// room_bandwidth_exceeded instead when the target has no room
+	codeMigrateFailed = "migrate_failed"
+	// A second connection for the same identity under
+	// DuplicateListenerReject (see duplicates.go)
+	codeDuplicateListener = "duplicate_listener"
+	// In the 503 body when a join is turned away before upgrading
+	codeServerBusy = "server_busy"
+)
+
+// WebSocket close codes for errors that end the connection
+var closeCodes = map[string]int{
+	codeShuttingDown:       websocket.CloseGoingAway,
+	codeBroadcasterExists:  websocket.CloseTryAgainLater,
+	codeRoomFull:           websocket.CloseTryAgainLater,
+	codeBandwidthExceeded:  websocket.CloseTryAgainLater,
+	codeTooManyConnections: websocket.CloseTryAgainLater,
+	codeRenegotiationFlood: websocket.ClosePolicyViolation,
+	codeRateLimited:        websocket.ClosePolicyViolation,
+	codeHandshakeTimeout:   websocket.CloseNormalClosure,
+	codePCCreateFailed:     websocket.CloseInternalServerErr,
+	codeMigrateFailed:      websocket.CloseInternalServerErr,
+	codeDuplicateListener:  websocket.ClosePolicyViolation,
+}
+
+// Send an error and close the socket with the matching close code, the
+// message doubling as the close reason
+func fail(ws *signalConn, code, message string) {
+	sendError(ws, code, message)
+	closeCode, ok := closeCodes[code]
+	if !ok {
+		closeCode = websocket.CloseNormalClosure
+	}
+	ws.CloseWith(closeCode, message)
+}
+
+func sendError(ws *signalConn, code, message string) error {
+	return ws.WriteJSON(map[string]string{
+		"type":    "error",
+		"code":    code,
+		"message": message,
+	})
+}
+
+// Tell a client it sent the wrong half of the offer/answer exchange for
+// its role: broadcasters offer, listeners answer
+func sendUnexpected(ws *signalConn, got, expected string) error {
+	return ws.WriteJSON(map[string]string{
+		"type":     "error",
+		"code":     codeUnexpectedMessage,
+		"message":  "Unexpected " + got + " for this role; send an " + expected,
+		"expected": expected,
+	})
+}
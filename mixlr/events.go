@@ -0,0 +1,154 @@
+package mixlr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Room lifecycle events, published to /events subscribers
+const (
+	eventRoomCreated        = "room_created"
+	eventBroadcasterStarted = "broadcaster_started"
+	eventBroadcasterLeft    = "broadcaster_left"
+	eventListenersChanged   = "listeners_changed"
+	// A reserved room was removed, never having had a broadcaster
+	eventRoomExpired = "room_expired"
+	// A room went unused for Options.RoomIdleTimeout and was removed
+	eventRoomRemoved = "room_removed"
+	// The listener count reached one of the room's milestones for the
+	// first time (see Options.ListenerMilestones)
+	eventListenerMilestone = "listener_milestone"
+	// The room's first ever listener joined
+	eventFirstListener = "first_listener"
+)
+
+// Events buffered per subscriber before a slow one starts missing them
+const eventBufferSize = 64
+
+// Keeps idle SSE connections from being reaped by proxies
+const eventKeepAlive = 30 * time.Second
+
+type roomEvent struct {
+	Type      string `json:"type"`
+	Room      string `json:"room"`
+	Time      string `json:"time"`
+	Listeners *int   `json:"listeners,omitempty"`
+	// listeners_changed: the listener who joined or left
+	Peer string `json:"peer,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+// Fan-out of room events to any number of subscribers. Publishing never
+// blocks: a subscriber that can't keep up drops events.
+type eventBus struct {
+	mu   sync.Mutex
+	subs map[chan roomEvent]struct{}
+}
+
+func (bus *eventBus) subscribe() chan roomEvent {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	if bus.subs == nil {
+		bus.subs = make(map[chan roomEvent]struct{})
+	}
+	ch := make(chan roomEvent, eventBufferSize)
+	bus.subs[ch] = struct{}{}
+	return ch
+}
+
+func (bus *eventBus) unsubscribe(ch chan roomEvent) {
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	delete(bus.subs, ch)
+}
+
+func (bus *eventBus) publish(ev roomEvent) {
+	if bus == nil {
+		return
+	}
+	if ev.Time == "" {
+		ev.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+	for ch := range bus.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Publish to the server's /events stream and the room's webhook
+func (room *Room) publish(ev roomEvent) {
+	ev.Room = room.Name
+	room.events.publish(ev)
+	room.webhook.send(ev)
+}
+
+// Caller must hold room.mu. grew is true when p was just added, false
+// when it just left.
+func (room *Room) publishListeners(p *peer, grew bool) {
+	count := len(room.Listeners)
+	room.events.publish(roomEvent{Type: eventListenersChanged, Room: room.Name, Listeners: &count, Peer: p.id, Name: p.displayName()})
+
+	// Webhooks only hear about firsts; every change would be a flood
+	if !grew {
+		return
+	}
+	if !room.hadListener {
+		room.hadListener = true
+		room.publish(roomEvent{Type: eventFirstListener, Listeners: &count})
+	}
+	// Each milestone fires once per room, however often the count dips
+	// back under it
+	for room.nextMilestone < len(room.milestones) && count >= room.milestones[room.nextMilestone] {
+		milestone := room.milestones[room.nextMilestone]
+		room.nextMilestone++
+		room.publish(roomEvent{Type: eventListenerMilestone, Listeners: &milestone})
+	}
+}
+
+// Server-Sent Events stream of room lifecycle events (admin only)
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.quit:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case ev := <-events:
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		}
+		flusher.Flush()
+	}
+}
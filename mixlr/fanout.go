@@ -0,0 +1,133 @@
+package mixlr
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Pion writes a track's packets to each listener in turn, so in a very
+// large room the last listener's copy of every packet waits on all the
+// others. With Options.FanoutWorkers > 1 the main room track is split into
+// that many shard tracks, listeners are spread across them round-robin,
+// and once the room has FanoutThreshold listeners each packet is written
+// to all shards in parallel. Below the threshold the shards are written
+// one after another, which costs the same as a single track.
+type fanout struct {
+	// shards[0] is room.track
+	shards    []*webrtc.TrackLocalStaticRTP
+	threshold int
+	next      atomic.Uint32
+}
+
+// Default Options.FanoutThreshold
+const defaultFanoutThreshold = 500
+
+// Split the room's main track into workers shards. Must be called before
+// any listener joins.
+func (room *Room) splitFanout(workers, threshold int) error {
+	room.fanout.shards = []*webrtc.TrackLocalStaticRTP{room.track}
+	if threshold <= 0 {
+		threshold = defaultFanoutThreshold
+	}
+	room.fanout.threshold = threshold
+	for i := 1; i < workers; i++ {
+		// Same IDs as the main track; each listener only ever has one
+		shard, err := webrtc.NewTrackLocalStaticRTP(room.track.Codec(), room.track.ID(), room.track.StreamID())
+		if err != nil {
+			return err
+		}
+		room.fanout.shards = append(room.fanout.shards, shard)
+	}
+	return nil
+}
+
+// Pick the shard a new listener receives the main track from
+func (room *Room) assignShard(p *peer) {
+	if n := len(room.fanout.shards); n > 1 {
+		p.shard = int(room.fanout.next.Add(1)) % n
+	}
+}
+
+// The listener's copy of the main room track
+func (room *Room) mainTrackFor(p *peer) *webrtc.TrackLocalStaticRTP {
+	if p.shard < len(room.fanout.shards) {
+		return room.fanout.shards[p.shard]
+	}
+	return room.track
+}
+
+// Writes main-track packets to every listener, for one forwarding
+// goroutine. Errors come from listeners that are tearing down, so they're
+// dropped. With shards, a worker per extra shard is kept for the parallel
+// case, each with its own copy of the packet as interceptors may touch
+// header extensions, so nothing is started or allocated per packet.
+type fanoutWriter struct {
+	room    *Room
+	workers []*shardWorker
+	wg      sync.WaitGroup
+}
+
+type shardWorker struct {
+	shard *webrtc.TrackLocalStaticRTP
+	pkt   packetCopy
+	next  chan struct{}
+}
+
+// Start a writer for the room's main track; close it when done
+func (room *Room) newFanoutWriter() *fanoutWriter {
+	fw := &fanoutWriter{room: room}
+	if len(room.fanout.shards) > 1 {
+		for _, shard := range room.fanout.shards[1:] {
+			w := &shardWorker{shard: shard, next: make(chan struct{})}
+			fw.workers = append(fw.workers, w)
+			go fw.run(w)
+		}
+	}
+	return fw
+}
+
+func (fw *fanoutWriter) run(w *shardWorker) {
+	where := "fanout shard in room " + fw.room.Name
+	for range w.next {
+		func() {
+			defer fw.wg.Done()
+			defer recoverPanic(where, nil)
+			w.shard.WriteRTP(&w.pkt.pkt)
+		}()
+	}
+}
+
+func (fw *fanoutWriter) write(pkt *rtp.Packet) {
+	room := fw.room
+	shards := room.fanout.shards
+	if len(shards) <= 1 {
+		room.track.WriteRTP(pkt)
+		return
+	}
+	if int(room.listenerCount.Load()) < room.fanout.threshold {
+		for _, shard := range shards {
+			shard.WriteRTP(pkt)
+		}
+		return
+	}
+
+	for _, w := range fw.workers {
+		if w.pkt.set(pkt) != nil {
+			continue
+		}
+		fw.wg.Add(1)
+		w.next <- struct{}{}
+	}
+	shards[0].WriteRTP(pkt)
+	fw.wg.Wait()
+}
+
+// Stop the shard workers
+func (fw *fanoutWriter) close() {
+	for _, w := range fw.workers {
+		close(w.next)
+	}
+}
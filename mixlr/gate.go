@@ -0,0 +1,341 @@
+package mixlr
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// A listener is attached to the room's tracks before its connection is up,
+// so pion starts handing it packets as soon as the answer is applied. Until
+// DTLS completes those go through NACK buffering, TWCC and pacing only to be
+// dropped at the transport. The gate drops them first instead, and opens
+// once the connection reports Connected.
+//
+// It also watches for a listener that can't keep up: after slowWriteLimit
+// consecutive writes that fail or take longer than slowWriteTime, its
+// packets are dropped for degradedBackoff so it can't hold up the rest of
+// the fanout, and it's told {"type":"degraded"} (then {"type":"recovered"}
+// once writes are quick again).
+//
+// With Options.PreconnectBuffer set, the gate keeps the last few packets of
+// each stream while closed instead of dropping them all, and sends them on
+// as it opens. The buffers are fixed-size rings that drop their oldest
+// packet when full, and are freed if the peer hasn't connected within
+// preconnectTimeout, so a listener that never connects costs a bounded
+// amount of memory for a bounded time.
+type sendGate struct {
+	interceptor.NoOp
+	open atomic.Bool
+
+	// Pre-connect buffering; 0 size disables
+	bufferSize int
+	buffering  atomic.Bool
+	bufferStop *time.Timer
+
+	slowStreak atomic.Int32
+	// Unix nanos until which packets are dropped; 0 when healthy
+	degradedUntil atomic.Int64
+	// Set before the gate opens
+	onDegraded func(degraded bool)
+
+	// Bound outgoing streams by SSRC, for priming
+	mu      sync.Mutex
+	streams map[uint32]gatedStream
+}
+
+// How long a closed gate keeps buffering before giving up on the peer
+const preconnectTimeout = 5 * time.Second
+
+const (
+	slowWriteTime   = 5 * time.Millisecond
+	slowWriteLimit  = 25
+	degradedBackoff = time.Second
+)
+
+type gatedStream struct {
+	writer      interceptor.RTPWriter
+	payloadType uint8
+	// Packets held while the gate is closed; nil without buffering
+	buffer *packetRing
+	splice *streamSplice
+}
+
+// When a listener migrates, its main stream stays put while the packets on
+// it switch to another room's sequence numbers and timestamps. The splice
+// shifts them to carry on from the last packet the listener was sent, so
+// its decoder and SRTP replay window see one unbroken stream.
+type streamSplice struct {
+	mu        sync.Mutex
+	clockRate uint32
+	sent      bool
+	lastSeq   uint16
+	lastTS    uint32
+	lastAt    time.Time
+	// Rebase at the next break in sequence: packets from the old track
+	// can still be in flight when the splice is requested
+	pending   bool
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+func (sp *streamSplice) apply(header *rtp.Header) {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+
+	now := time.Now()
+	seq := header.SequenceNumber + sp.seqOffset
+	if sp.pending && sp.sent && seq != sp.lastSeq+1 {
+		sp.pending = false
+		ticks := uint32(now.Sub(sp.lastAt).Seconds() * float64(sp.clockRate))
+		sp.seqOffset = sp.lastSeq + 1 - header.SequenceNumber
+		sp.tsOffset = sp.lastTS + max(ticks, 1) - header.Timestamp
+		seq = sp.lastSeq + 1
+	}
+	header.SequenceNumber = seq
+	header.Timestamp += sp.tsOffset
+	sp.sent = true
+	sp.lastSeq = header.SequenceNumber
+	sp.lastTS = header.Timestamp
+	sp.lastAt = now
+}
+
+type gateFactory struct {
+	s *Server
+}
+
+// Called inside NewPeerConnection, under pcCreateMu
+func (f *gateFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	g := &sendGate{streams: make(map[uint32]gatedStream), bufferSize: f.s.opts.PreconnectBuffer}
+	if g.bufferSize > 0 {
+		g.buffering.Store(true)
+		g.bufferStop = time.AfterFunc(preconnectTimeout, g.dropBuffers)
+	}
+	f.s.newGate = g
+	return g, nil
+}
+
+func (g *sendGate) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	stream := gatedStream{writer: writer, payloadType: info.PayloadType, splice: &streamSplice{clockRate: info.ClockRate}}
+	if g.bufferSize > 0 {
+		stream.buffer = newPacketRing(g.bufferSize)
+	}
+	g.mu.Lock()
+	g.streams[info.SSRC] = stream
+	g.mu.Unlock()
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		if !g.open.Load() {
+			if stream.buffer != nil && g.buffering.Load() {
+				// Copied in, as the caller reuses its buffers once we return
+				stream.buffer.write(&rtp.Packet{Header: *header, Payload: payload})
+			}
+			return header.MarshalSize() + len(payload), nil
+		}
+		start := time.Now()
+		if until := g.degradedUntil.Load(); until != 0 && start.UnixNano() < until {
+			return header.MarshalSize() + len(payload), nil
+		}
+
+		stream.splice.apply(header)
+		n, err := writer.Write(header, payload, attributes)
+		// A closed transport is teardown, not a slow listener
+		slow := (err != nil && !errors.Is(err, io.ErrClosedPipe)) || time.Since(start) > slowWriteTime
+		g.track(slow, start)
+		return n, err
+	})
+}
+
+// Count slow writes and flip between healthy and degraded
+func (g *sendGate) track(slow bool, now time.Time) {
+	if slow {
+		if g.slowStreak.Add(1) < slowWriteLimit {
+			return
+		}
+		g.slowStreak.Store(0)
+		if g.degradedUntil.Swap(now.Add(degradedBackoff).UnixNano()) == 0 && g.onDegraded != nil {
+			go g.onDegraded(true)
+		}
+		return
+	}
+
+	g.slowStreak.Store(0)
+	if until := g.degradedUntil.Load(); until != 0 && g.degradedUntil.CompareAndSwap(until, 0) && g.onDegraded != nil {
+		go g.onDegraded(false)
+	}
+}
+
+// Splice the stream with the given SSRC onto whatever track it's sent next
+// (see streamSplice)
+func (g *sendGate) splice(ssrc uint32) {
+	g.mu.Lock()
+	stream, ok := g.streams[ssrc]
+	g.mu.Unlock()
+	if !ok {
+		return
+	}
+	stream.splice.mu.Lock()
+	stream.splice.pending = true
+	stream.splice.mu.Unlock()
+}
+
+func (g *sendGate) UnbindLocalStream(info *interceptor.StreamInfo) {
+	g.mu.Lock()
+	delete(g.streams, info.SSRC)
+	g.mu.Unlock()
+}
+
+// The peer never connected; free what was buffered for it
+func (g *sendGate) dropBuffers() {
+	g.buffering.Store(false)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, stream := range g.streams {
+		if stream.buffer != nil {
+			stream.buffer.reset()
+		}
+	}
+}
+
+// Open the gate, first sending primer (the room's most recent packets) on
+// the stream with the given SSRC so a late joiner has audio straight away.
+// The primer's sequence numbers and timestamps run straight into the live
+// packets that follow, so it only needs the stream's own SSRC and payload
+// type. Streams with pre-connect buffers send those instead, as they were
+// written for this peer already.
+func (g *sendGate) openWith(ssrc uint32, primer []*rtp.Packet) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.bufferStop != nil {
+		g.bufferStop.Stop()
+	}
+	g.buffering.Store(false)
+	for id, stream := range g.streams {
+		if stream.buffer == nil {
+			continue
+		}
+		buffered := stream.buffer.snapshot()
+		stream.buffer.reset()
+		if len(buffered) > 0 && id == ssrc {
+			primer = nil
+		}
+		for _, pkt := range buffered {
+			if _, err := stream.writer.Write(&pkt.Header, pkt.Payload, nil); err != nil {
+				break
+			}
+		}
+	}
+
+	if stream, ok := g.streams[ssrc]; ok {
+		for _, pkt := range primer {
+			header := pkt.Header
+			header.SSRC = ssrc
+			header.PayloadType = stream.payloadType
+			if _, err := stream.writer.Write(&header, pkt.Payload, nil); err != nil {
+				break
+			}
+		}
+	}
+	g.open.Store(true)
+}
+
+// The last few packets forwarded on a stream. Writers reuse their packets,
+// so each is copied in, into a slot whose buffer is reused in turn once
+// the ring has wrapped.
+type packetRing struct {
+	mu      sync.Mutex
+	packets []*packetCopy
+	next    int
+	full    bool
+}
+
+func newPacketRing(size int) *packetRing {
+	return &packetRing{packets: make([]*packetCopy, size)}
+}
+
+func (r *packetRing) write(pkt *rtp.Packet) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	slot := r.packets[r.next]
+	if slot == nil {
+		slot = new(packetCopy)
+		r.packets[r.next] = slot
+	}
+	if slot.set(pkt) != nil {
+		return
+	}
+	r.next = (r.next + 1) % len(r.packets)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Copies of the buffered packets, oldest first
+func (r *packetRing) snapshot() []*rtp.Packet {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	slots := r.packets[:r.next]
+	if r.full {
+		slots = append(append([]*packetCopy(nil), r.packets[r.next:]...), r.packets[:r.next]...)
+	}
+	packets := make([]*rtp.Packet, len(slots))
+	for i, slot := range slots {
+		packets[i] = slot.pkt.Clone()
+	}
+	return packets
+}
+
+// Clear the buffer when the stream stops, so a listener joining a silent
+// room isn't primed with stale audio
+func (r *packetRing) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	clear(r.packets)
+	r.next = 0
+	r.full = false
+}
+
+// Open a peer's gate once it's connected, priming listeners with the
+// room's recent audio when that's enabled
+func (room *Room) openGate(p *peer, gate *sendGate) {
+	// Connected fires again after an ICE hiccup; the gate is open already
+	if gate.open.Load() {
+		return
+	}
+	gate.onDegraded = func(degraded bool) {
+		msgType := "recovered"
+		if degraded {
+			msgType = "degraded"
+		}
+		log.Printf("Peer %s in room %s %s", p.id, room.Name, msgType)
+		p.ws.WriteJSON(map[string]string{"type": msgType})
+	}
+
+	if room.primer == nil || p.role == roleBroadcaster {
+		gate.openWith(0, nil)
+		return
+	}
+
+	room.mu.RLock()
+	sender := p.senders[mainTrack]
+	room.mu.RUnlock()
+	if sender == nil {
+		gate.openWith(0, nil)
+		return
+	}
+	var ssrc uint32
+	if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+		ssrc = uint32(encodings[0].SSRC)
+	}
+	gate.openWith(ssrc, room.primer.snapshot())
+}
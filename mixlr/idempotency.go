@@ -0,0 +1,94 @@
+package mixlr
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Longest Idempotency-Key accepted on /create
+const maxIdempotencyKeyLen = 255
+
+// Rooms created with an Idempotency-Key header, so a retried /create
+// (say, after a timeout) gets the room it already made instead of a second
+// one. Keys are scoped to the authenticated identity and kept for
+// Options.IdempotencyTTL.
+//
+// Concurrent retries with one key mustn't both create, so a create claims
+// its key with begin and others with that key wait for its finish. mu only
+// guards the maps; creates under different keys never wait on each other.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]idempotentRoom
+	// Keys with a create under way → closed when it finishes
+	inFlight map[string]chan struct{}
+}
+
+type idempotentRoom struct {
+	roomID  string
+	expires time.Time
+}
+
+// Claim key for a create, or return the room already created under it,
+// waiting out any create with the same key that's under way. Unless a room
+// is returned, the caller owns key until it calls finish.
+func (c *idempotencyCache) begin(ctx context.Context, key string) (string, bool, error) {
+	for {
+		c.mu.Lock()
+		if roomID, ok := c.lookup(key, time.Now()); ok {
+			c.mu.Unlock()
+			return roomID, true, nil
+		}
+		wait, busy := c.inFlight[key]
+		if !busy {
+			if c.inFlight == nil {
+				c.inFlight = make(map[string]chan struct{})
+			}
+			c.inFlight[key] = make(chan struct{})
+			c.mu.Unlock()
+			return "", false, nil
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return "", false, ctx.Err()
+		}
+	}
+}
+
+// Release key after a create, remembering roomID unless it's "" (the
+// create failed, so a retry should try again)
+func (c *idempotencyCache) finish(key, roomID string, now time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if roomID != "" {
+		c.store(key, roomID, now, ttl)
+	}
+	close(c.inFlight[key])
+	delete(c.inFlight, key)
+}
+
+// The room created under key, if it's still fresh. Caller must hold mu.
+func (c *idempotencyCache) lookup(key string, now time.Time) (string, bool) {
+	e, ok := c.entries[key]
+	if !ok || now.After(e.expires) {
+		return "", false
+	}
+	return e.roomID, true
+}
+
+// Remember the room created under key, dropping expired entries while at
+// it. Caller must hold mu.
+func (c *idempotencyCache) store(key, roomID string, now time.Time, ttl time.Duration) {
+	if c.entries == nil {
+		c.entries = make(map[string]idempotentRoom)
+	}
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = idempotentRoom{roomID: roomID, expires: now.Add(ttl)}
+}
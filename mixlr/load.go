@@ -0,0 +1,78 @@
+package mixlr
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// Suggested wait before a client rejected as busy tries again
+const busyRetryAfter = 5 * time.Second
+
+// Why the server can't take another connection right now, or "" if it can
+func (s *Server) overloaded() string {
+	if s.opts.MaxConnections > 0 {
+		s.connsMu.Lock()
+		n := len(s.conns)
+		s.connsMu.Unlock()
+		if n >= s.opts.MaxConnections {
+			return "connection limit reached"
+		}
+	}
+	if s.opts.MaxGoroutines > 0 && runtime.NumGoroutine() >= s.opts.MaxGoroutines {
+		return "goroutine limit reached"
+	}
+	if s.opts.Overloaded != nil && s.opts.Overloaded() {
+		return "overload signal set"
+	}
+	return ""
+}
+
+// Turn a new connection away with a 503 before upgrading, if the server is
+// over any of its load limits. Returns false if it did.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request) bool {
+	reason := s.overloaded()
+	if reason == "" {
+		return true
+	}
+	log.Printf("Server busy (%s), rejecting %s", reason, s.clientIP(r))
+	s.metrics.busyRejections.Add(1)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(int(busyRetryAfter.Seconds())))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":    codeServerBusy,
+		"message": "Server is busy, try again shortly",
+	})
+	return false
+}
+
+// Handle GET /capacity: current load against the limits, for a frontend
+// deciding whether a join is worth trying. Open to anyone, so it only
+// carries counts. Cacheable for busyRetryAfter, which is as stale as a
+// client turned away as busy would be anyway.
+func (s *Server) capacity(w http.ResponseWriter, r *http.Request) {
+	s.connsMu.Lock()
+	conns := len(s.conns)
+	closing := s.closing
+	s.connsMu.Unlock()
+
+	s.roomsMu.RLock()
+	rooms := len(s.rooms)
+	s.roomsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(busyRetryAfter.Seconds())))
+	json.NewEncoder(w).Encode(map[string]any{
+		"connections": conns,
+		// 0 means unlimited
+		"max_connections": s.opts.MaxConnections,
+		// Rooms have no server-wide cap, only MaxRoomsPerUser
+		"rooms":     rooms,
+		"accepting": !closing && s.overloaded() == "",
+	})
+}
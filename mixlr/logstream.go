@@ -0,0 +1,253 @@
+package mixlr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A LogHub copies the process's log output to admins tailing /admin/logs.
+// Install its Handler as the slog default and everything logged through
+// either slog or the log package passes through it:
+//
+//	logs := mixlr.NewLogHub()
+//	slog.SetDefault(slog.New(logs.Handler(os.Stderr)))
+//
+// Subscribers get records at or above the level they asked for. A socket
+// that can't keep up loses records rather than holding up the logger.
+type LogHub struct {
+	mu   sync.Mutex
+	subs map[*logSub]struct{}
+}
+
+// Records buffered per admin socket before they start being dropped
+const logSubBuffer = 256
+
+type logSub struct {
+	level   slog.Level
+	ch      chan []byte
+	dropped atomic.Int64
+}
+
+func NewLogHub() *LogHub {
+	return &LogHub{subs: make(map[*logSub]struct{})}
+}
+
+func (h *LogHub) subscribe(level slog.Level) *logSub {
+	sub := &logSub{level: level, ch: make(chan []byte, logSubBuffer)}
+	h.mu.Lock()
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+	return sub
+}
+
+func (h *LogHub) unsubscribe(sub *logSub) {
+	h.mu.Lock()
+	delete(h.subs, sub)
+	h.mu.Unlock()
+}
+
+// Whether any subscriber wants records at level
+func (h *LogHub) wants(level slog.Level) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if level >= sub.level {
+			return true
+		}
+	}
+	return false
+}
+
+// Hand an event to every subscriber that wants it, never waiting on one
+func (h *LogHub) publish(level slog.Level, event []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if level < sub.level {
+			continue
+		}
+		select {
+		case sub.ch <- event:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// A slog.Handler that writes Info and above to out in the log package's
+// usual "2006/01/02 15:04:05 message" form, followed by any attributes as
+// key=value, and copies records to the hub's subscribers
+func (h *LogHub) Handler(out io.Writer) slog.Handler {
+	return &logHandler{hub: h, out: out, mu: new(sync.Mutex)}
+}
+
+type logHandler struct {
+	hub    *LogHub
+	out    io.Writer
+	mu     *sync.Mutex // shared by everything derived from the same Handler
+	attrs  []slog.Attr // already qualified by their groups
+	prefix string      // open groups, "a.b."
+}
+
+// One record as sent to /admin/logs subscribers
+type logEvent struct {
+	Time  time.Time      `json:"time"`
+	Level string         `json:"level"`
+	Msg   string         `json:"msg"`
+	Attrs map[string]any `json:"attrs,omitempty"`
+}
+
+func (l *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelInfo || l.hub.wants(level)
+}
+
+func (l *logHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := l.attrs
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = appendAttr(attrs, l.prefix, a)
+		return true
+	})
+
+	var err error
+	if r.Level >= slog.LevelInfo {
+		var b strings.Builder
+		b.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+		if r.Level != slog.LevelInfo {
+			b.WriteString(r.Level.String() + " ")
+		}
+		b.WriteString(strings.TrimSuffix(r.Message, "\n"))
+		for _, a := range attrs {
+			fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		}
+		b.WriteByte('\n')
+		l.mu.Lock()
+		_, err = io.WriteString(l.out, b.String())
+		l.mu.Unlock()
+	}
+
+	if l.hub.wants(r.Level) {
+		ev := logEvent{Time: r.Time, Level: r.Level.String(), Msg: strings.TrimSuffix(r.Message, "\n")}
+		if len(attrs) > 0 {
+			ev.Attrs = make(map[string]any, len(attrs))
+			for _, a := range attrs {
+				ev.Attrs[a.Key] = a.Value.Any()
+			}
+		}
+		// Not logged on failure: that would come straight back here
+		if data, merr := json.Marshal(ev); merr == nil {
+			l.hub.publish(r.Level, data)
+		}
+	}
+	return err
+}
+
+func (l *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *l
+	c.attrs = append([]slog.Attr(nil), l.attrs...)
+	for _, a := range attrs {
+		c.attrs = appendAttr(c.attrs, l.prefix, a)
+	}
+	return &c
+}
+
+func (l *logHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return l
+	}
+	c := *l
+	c.prefix += name + "."
+	return &c
+}
+
+// Flatten a into list, group members keyed "group.key"
+func appendAttr(list []slog.Attr, prefix string, a slog.Attr) []slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, g := range a.Value.Group() {
+			list = appendAttr(list, prefix, g)
+		}
+		return list
+	}
+	if a.Equal(slog.Attr{}) {
+		return list
+	}
+	return append(list, slog.Attr{Key: prefix + a.Key, Value: a.Value})
+}
+
+// GET /admin/logs?level=debug|info|warn|error upgrades to a WebSocket that
+// streams log records at or above the level (default info) as
+// {"time","level","msg","attrs"}. Records lost to a slow reader are
+// reported as {"dropped":n} before the next one that gets through.
+func (s *Server) streamLogs(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+	if s.opts.Logs == nil {
+		http.Error(w, "Log streaming is not enabled", http.StatusNotFound)
+		return
+	}
+	level := slog.LevelInfo
+	if v := r.URL.Query().Get("level"); v != "" {
+		if err := level.UnmarshalText([]byte(v)); err != nil {
+			http.Error(w, "level must be debug, info, warn or error", http.StatusBadRequest)
+			return
+		}
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return
+	}
+	defer conn.Close()
+
+	sub := s.opts.Logs.subscribe(level)
+	defer s.opts.Logs.unsubscribe(sub)
+
+	// Nothing is expected from the admin; reading just notices the close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-s.quit:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(time.Second))
+			return
+		case event := <-sub.ch:
+			if n := sub.dropped.Swap(0); n > 0 {
+				if conn.WriteJSON(map[string]int64{"dropped": n}) != nil {
+					return
+				}
+			}
+			if conn.WriteMessage(websocket.TextMessage, event) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package mixlr
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// A room created with low_bitrate_kbps watches its broadcaster's uplink:
+// when the main track's bitrate, averaged over low_bitrate_window, falls
+// below the floor, the broadcaster and moderators are sent
+// {"type":"low_bitrate","kbps":N,"floor":F}, and
+// {"type":"bitrate_recovered","kbps":N} once it's back above. Opus DTX
+// sends next to nothing during silence, so broadcasters using it need a
+// window longer than their pauses. The window is also checked every
+// second without packets, so an uplink that stalls altogether is caught.
+
+const defaultLowBitrateWindow = 10 * time.Second
+
+// Rolling average of bytes received, in one-second buckets. Fed by the
+// forwarding goroutine and checked by its ticker.
+type bitrateWatch struct {
+	mu      sync.Mutex
+	floor   int
+	buckets []int
+	next    int
+	// Buckets filled so far, up to len(buckets)
+	seen int
+	// Bytes in the second under way
+	current     int
+	bucketStart time.Time
+	low         bool
+}
+
+// The room's watch, or nil if it has no floor
+func (room *Room) newBitrateWatch() *bitrateWatch {
+	if room.LowBitrateKbps <= 0 {
+		return nil
+	}
+	n := max(int(room.LowBitrateWindow/time.Second), 1)
+	return &bitrateWatch{floor: room.LowBitrateKbps * 1000, buckets: make([]int, n)}
+}
+
+// Count n bytes arriving at now. Caller must hold w.mu. At each second boundary, once a whole
+// window has been seen, reports the window's average in kbit/s and whether
+// it crossed the floor in either direction.
+func (w *bitrateWatch) add(now time.Time, n int) (kbps int, crossed bool) {
+	if w.bucketStart.IsZero() {
+		w.bucketStart = now
+	}
+	if steps := int(now.Sub(w.bucketStart) / time.Second); steps > 0 {
+		w.bucketStart = w.bucketStart.Add(time.Duration(steps) * time.Second)
+		// The second under way closes first; any after it had nothing at
+		// all, so count as zero
+		for i := 0; i < min(steps, len(w.buckets)); i++ {
+			w.buckets[w.next] = w.current
+			w.current = 0
+			w.next = (w.next + 1) % len(w.buckets)
+			w.seen = min(w.seen+1, len(w.buckets))
+		}
+		if w.seen == len(w.buckets) {
+			total := 0
+			for _, b := range w.buckets {
+				total += b
+			}
+			bps := total * 8 / len(w.buckets)
+			kbps = bps / 1000
+			if low := bps < w.floor; low != w.low {
+				w.low = low
+				crossed = true
+			}
+		}
+	}
+	w.current += n
+	return kbps, crossed
+}
+
+// Feed the watch a packet of n bytes, or none, and tell the broadcaster and
+// moderators when the uplink crosses the floor
+func (room *Room) checkBitrate(w *bitrateWatch, n int) {
+	w.mu.Lock()
+	kbps, crossed := w.add(time.Now(), n)
+	low := w.low
+	w.mu.Unlock()
+	if !crossed {
+		return
+	}
+	if low {
+		log.Printf("Room %s broadcaster bitrate down to %d kbit/s (floor %d)", room.Name, kbps, room.LowBitrateKbps)
+		room.tellModerators(map[string]any{"type": "low_bitrate", "kbps": kbps, "floor": room.LowBitrateKbps})
+		return
+	}
+	log.Printf("Room %s broadcaster bitrate recovered to %d kbit/s", room.Name, kbps)
+	room.tellModerators(map[string]any{"type": "bitrate_recovered", "kbps": kbps})
+}
+
+// Check the window every second until done is closed, for when no packets
+// come at all
+func (room *Room) watchBitrate(w *bitrateWatch, done <-chan struct{}) {
+	defer recoverPanic("bitrate watch for room "+room.Name, nil)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			room.checkBitrate(w, 0)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package mixlr
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Counters exported at /metrics in the Prometheus text format
+type metrics struct {
+	// Established peer connections by ICE path; relay means TURN on
+	// either side, which is what costs money
+	relayConns  atomic.Int64
+	directConns atomic.Int64
+
+	// Joins turned away with 503 by the load limits (see load.go)
+	busyRejections atomic.Int64
+}
+
+// Count a newly connected peer by its selected candidate pair. Safe to
+// call on every transition to connected; only the first one counts.
+func (s *Server) countConnection(p *peer) {
+	pair := p.selectedPair()
+	if pair == nil {
+		return
+	}
+	path := "direct"
+	if pair.Local.Typ == webrtc.ICECandidateTypeRelay || pair.Remote.Typ == webrtc.ICECandidateTypeRelay {
+		path = "relay"
+	}
+	if !p.path.CompareAndSwap(nil, &path) {
+		return
+	}
+	s.connCounter(path).Add(1)
+}
+
+// Stored in peer.path once the peer is gone, so a late connected
+// callback can't count it again
+var pathGone = new(string)
+
+// Undo countConnection when the peer goes away
+func (s *Server) uncountConnection(p *peer) {
+	if path := p.path.Swap(pathGone); path != nil && path != pathGone {
+		s.connCounter(*path).Add(-1)
+	}
+}
+
+func (s *Server) connCounter(path string) *atomic.Int64 {
+	if path == "relay" {
+		return &s.metrics.relayConns
+	}
+	return &s.metrics.directConns
+}
+
+func (s *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	s.roomsMu.RLock()
+	rooms := len(s.rooms)
+	listeners, live := 0, 0
+	for _, room := range s.rooms {
+		room.mu.RLock()
+		listeners += len(room.Listeners)
+		if room.Broadcaster != nil {
+			live++
+		}
+		room.mu.RUnlock()
+	}
+	s.roomsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "# HELP mixlr_connections Established peer connections by ICE path.\n")
+	fmt.Fprintf(w, "# TYPE mixlr_connections gauge\n")
+	fmt.Fprintf(w, "mixlr_connections{path=\"direct\"} %d\n", s.metrics.directConns.Load())
+	fmt.Fprintf(w, "mixlr_connections{path=\"relay\"} %d\n", s.metrics.relayConns.Load())
+	fmt.Fprintf(w, "# HELP mixlr_rooms Rooms on this instance.\n")
+	fmt.Fprintf(w, "# TYPE mixlr_rooms gauge\n")
+	fmt.Fprintf(w, "mixlr_rooms %d\n", rooms)
+	fmt.Fprintf(w, "# HELP mixlr_rooms_live Rooms with a broadcaster connected.\n")
+	fmt.Fprintf(w, "# TYPE mixlr_rooms_live gauge\n")
+	fmt.Fprintf(w, "mixlr_rooms_live %d\n", live)
+	fmt.Fprintf(w, "# HELP mixlr_listeners Listener connections across all rooms.\n")
+	fmt.Fprintf(w, "# TYPE mixlr_listeners gauge\n")
+	fmt.Fprintf(w, "mixlr_listeners %d\n", listeners)
+	fmt.Fprintf(w, "# HELP mixlr_busy_rejections_total Joins rejected because the server was over a load limit.\n")
+	fmt.Fprintf(w, "# TYPE mixlr_busy_rejections_total counter\n")
+	fmt.Fprintf(w, "mixlr_busy_rejections_total %d\n", s.metrics.busyRejections.Load())
+}
@@ -0,0 +1,155 @@
+package mixlr
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Listeners can hop between rooms without reconnecting, e.g. from one show
+// to the next: {"type":"migrate","room":id}, with "passphrase" if the
+// target has one, moves the listener from this room's fanout to the
+// target's over the same peer connection, which is then renegotiated. The
+// listener is told {"type":"migrated","room":id} and then the new room's
+// status, as on join. A rejected migrate leaves the listener where it was,
+// even one that fails part way through; only if the old room filled up in
+// the meantime is the connection closed instead. Idle and listen-time
+// limits stay those of the room first joined.
+
+// Handle a migrate request, returning the room the listener is now in
+func (s *Server) migrate(p *peer, from *Room, msgMap map[string]json.RawMessage) *Room {
+	var target, passphrase string
+	if json.Unmarshal(msgMap["room"], &target) != nil || target == "" {
+		sendError(p.ws, codeMigrateFailed, "room is required")
+		return from
+	}
+	json.Unmarshal(msgMap["passphrase"], &passphrase)
+
+	s.roomsMu.RLock()
+	to := s.rooms[target]
+	s.roomsMu.RUnlock()
+
+	reason := ""
+	switch {
+	case to == nil:
+		reason = "Room not found"
+	case to == from:
+		reason = "Already in this room"
+	case to.Stereo != from.Stereo:
+		// The connection negotiated one channel layout
+		reason = "Room uses a different audio format"
+	case !secretMatches(to.ListenerPassphrase, passphrase):
+		reason = "Invalid listener passphrase"
+	}
+	if reason != "" {
+		sendError(p.ws, codeMigrateFailed, reason)
+		return from
+	}
+
+	// Check before leaving, so a full room doesn't strand the listener;
+	// addListener checks again in case it filled up meanwhile
+	to.mu.RLock()
+	code := to.capacityCode()
+	if to.duplicates == DuplicateListenerReject && to.duplicateOf(p) != nil {
+		code = codeDuplicateListener
+	}
+	to.mu.RUnlock()
+	if code != "" {
+		sendError(p.ws, code, joinMessage(code))
+		return from
+	}
+
+	from.removeListener(p.pc)
+	p.room.Store(to)
+	if err := to.moveIn(p); err != nil {
+		log.Printf("Migrating %s to room %s: %v", p.id, to.Name, err)
+		return s.migrateBack(p, from, codeMigrateFailed, "Could not switch rooms")
+	}
+	if code := to.addListener(p); code != "" {
+		return s.migrateBack(p, from, code, joinMessage(code))
+	}
+	// The connection may have closed mid-move, after the old room's
+	// cleanup ran and before this one knew about it
+	select {
+	case <-p.pcGone:
+		to.removeListener(p.pc)
+		return to
+	default:
+	}
+
+	if p.session != nil {
+		s.sessionsMu.Lock()
+		p.session.room = to
+		s.sessionsMu.Unlock()
+	}
+
+	log.Printf("Listener %s migrated from room %s to %s", p.id, from.Name, to.Name)
+	p.ws.WriteJSON(map[string]string{"type": "migrated", "room": to.Name})
+	to.greet(p.ws)
+	if p.metadata != nil && p.metadata.ReadyState() == webrtc.DataChannelStateOpen {
+		to.mu.RLock()
+		last := to.lastMetadata
+		to.mu.RUnlock()
+		if last != nil {
+			sendMetadata(p.metadata, *last)
+		}
+	}
+	go p.renegotiate(to)
+	return to
+}
+
+// Return a listener whose migrate failed after leaving from, then report
+// the failure. The connection is closed if from won't take it back.
+func (s *Server) migrateBack(p *peer, from *Room, code, message string) *Room {
+	p.room.Store(from)
+	if err := from.moveIn(p); err != nil {
+		log.Printf("Returning %s to room %s: %v", p.id, from.Name, err)
+		fail(p.ws, codeMigrateFailed, "Could not switch rooms")
+		return from
+	}
+	if rejoin := from.addListener(p); rejoin != "" {
+		fail(p.ws, rejoin, joinMessage(rejoin))
+		return from
+	}
+	select {
+	case <-p.pcGone:
+		from.removeListener(p.pc)
+		return from
+	default:
+	}
+	sendError(p.ws, code, message)
+	// Undo whatever the move changed on the connection
+	go p.renegotiate(from)
+	return from
+}
+
+// Swap the listener's tracks for this room's: the main sender switches
+// track in place, spliced so the stream runs on unbroken, and the old
+// room's extras are dropped (addListener attaches this room's).
+// Subscriptions start over.
+func (room *Room) moveIn(p *peer) error {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	for name, sender := range p.senders {
+		if name == mainTrack {
+			continue
+		}
+		delete(p.senders, name)
+		if err := p.pc.RemoveTrack(sender); err != nil {
+			return err
+		}
+	}
+	clear(p.unsubscribed)
+
+	room.assignShard(p)
+	if sender := p.senders[mainTrack]; sender != nil {
+		if encodings := sender.GetParameters().Encodings; len(encodings) > 0 && p.gate != nil {
+			p.gate.splice(uint32(encodings[0].SSRC))
+		}
+		return sender.ReplaceTrack(room.mainTrackFor(p))
+	}
+	room.attach(p, mainTrack)
+	return nil
+}
@@ -0,0 +1,253 @@
+package mixlr
+
+import (
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// Co-hosted shows: with max_broadcasters above 1, up to that many
+// broadcasters join at once and their audio is mixed into the one room
+// track. Each broadcaster's Opus is decoded into a jitter buffer of its own;
+// every 20ms the buffered audio is summed and encoded as a single stream.
+// Broadcasters join and leave the mix freely, and it runs for as long as
+// anyone is feeding it. Every audio track a broadcaster sends goes into
+// the mix; there are no extra named tracks in a mixed room. The first
+// broadcaster in is the lead, who hears the room's notices as a lone
+// broadcaster would; when the lead leaves, a co-host takes over. Needs a
+// server built with -tags opus (see opus.go).
+
+const (
+	// Most broadcasters max_broadcasters may allow
+	maxMixBroadcasters = 16
+
+	mixInterval = 20 * time.Millisecond
+	// Frames an input buffers before it's heard, to ride out jitter
+	mixPrebuffer = 3
+	// Most frames an input may queue; the oldest go past it, so a sender
+	// whose clock runs fast can't build up delay
+	mixMaxBuffer = 10
+)
+
+type mixer struct {
+	room *Room
+
+	mu     sync.Mutex
+	inputs map[*mixInput]struct{}
+	// Whether run is going
+	running bool
+}
+
+// One broadcaster track's decoded audio, waiting to be mixed
+type mixInput struct {
+	pcm []int16
+	// Buffered enough to be heard; cleared when it runs dry
+	ready bool
+}
+
+func newMixer(room *Room) *mixer {
+	return &mixer{room: room, inputs: make(map[*mixInput]struct{})}
+}
+
+// Whether the room mixes several broadcasters
+func (room *Room) mixing() bool {
+	return room.mixer != nil
+}
+
+// Feed a broadcaster track into the mix until it ends, starting the mix if
+// it isn't running. startSinks gives the Icecast relay and recording for a
+// newly started mix.
+func (m *mixer) feed(track *webrtc.TrackRemote, startSinks func() ([]packetSink, func())) {
+	channels := int(m.room.channels())
+	dec, err := newOpusDecoder(channels)
+	if err != nil {
+		log.Printf("Mixing in room %s: %v", m.room.Name, err)
+		return
+	}
+	defer dec.close()
+
+	in := &mixInput{}
+	m.mu.Lock()
+	m.inputs[in] = struct{}{}
+	if !m.running {
+		m.running = true
+		go m.run(startSinks)
+	}
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.inputs, in)
+		m.mu.Unlock()
+	}()
+
+	frame := opusFrameTicks * channels
+	pcm := make([]int16, opusMaxPacket*channels)
+	var rd rtpReader
+	for {
+		pkt, err := rd.read(track)
+		if err != nil {
+			return
+		}
+		n, err := dec.decode(pkt.Payload, pcm)
+		if err != nil {
+			continue
+		}
+
+		m.mu.Lock()
+		in.push(pcm[:n*channels], frame)
+		m.mu.Unlock()
+	}
+}
+
+// Queue decoded audio, frame samples (all channels) to a 20ms frame.
+// Caller must hold the mixer's mu.
+func (in *mixInput) push(pcm []int16, frame int) {
+	in.pcm = append(in.pcm, pcm...)
+	if over := len(in.pcm) - mixMaxBuffer*frame; over > 0 {
+		in.pcm = in.pcm[:copy(in.pcm, in.pcm[over:])]
+	}
+	if len(in.pcm) >= mixPrebuffer*frame {
+		in.ready = true
+	}
+}
+
+// Mix until nobody is feeding the mixer. Everything a mix started is torn
+// down before running is cleared, so a mix started straight after never
+// overlaps this one.
+func (m *mixer) run(startSinks func() ([]packetSink, func())) {
+	defer recoverPanic("mixer for room "+m.room.Name, func() {
+		m.mu.Lock()
+		m.running = false
+		m.mu.Unlock()
+	})
+	for {
+		m.mix(startSinks)
+
+		m.mu.Lock()
+		if len(m.inputs) == 0 {
+			m.running = false
+			m.mu.Unlock()
+			return
+		}
+		m.mu.Unlock()
+	}
+}
+
+// One stretch of mixing, from the first input to the last leaving
+func (m *mixer) mix(startSinks func() ([]packetSink, func())) {
+	room := m.room
+	channels := int(room.channels())
+	enc, err := newOpusEncoder(channels, transcodeBitrate*channels)
+	if err != nil {
+		log.Printf("Mixing in room %s: %v", room.Name, err)
+		// Nothing will be mixed, so wait for the inputs to go
+		for m.hasInputs() {
+			time.Sleep(mixInterval)
+		}
+		return
+	}
+	defer enc.close()
+
+	room.mu.Lock()
+	room.mainLive = true
+	started := room.StartedAt.IsZero()
+	if started {
+		room.StartedAt = time.Now()
+	}
+	room.mu.Unlock()
+	if started {
+		room.publish(roomEvent{Type: eventBroadcasterStarted})
+	}
+	defer func() {
+		room.mu.Lock()
+		room.mainLive = false
+		room.mu.Unlock()
+		if room.primer != nil {
+			room.primer.reset()
+		}
+	}()
+	log.Printf("Mix started in room %s", room.Name)
+	defer log.Printf("Mix stopped in room %s", room.Name)
+
+	sinks, stopSinks := startSinks()
+	defer stopSinks()
+	fw := room.newFanoutWriter()
+	defer fw.close()
+
+	frame := opusFrameTicks * channels
+	sum := make([]int32, frame)
+	mixed := make([]int16, frame)
+	payload := make([]byte, opusMaxBytes)
+	pkt := rtp.Packet{Header: rtp.Header{Version: 2}}
+	room.rewriter.rebase(&pkt, opusRate)
+
+	ticker := time.NewTicker(mixInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !m.take(sum) {
+			return
+		}
+		for i, v := range sum {
+			mixed[i] = int16(max(math.MinInt16, min(math.MaxInt16, v)))
+		}
+		size, err := enc.encode(mixed, payload)
+		if err != nil {
+			log.Printf("Mixing in room %s: %v", room.Name, err)
+			continue
+		}
+		pkt.Payload = payload[:size]
+		room.relay(&pkt, fw, sinks)
+		pkt.SequenceNumber++
+		pkt.Timestamp += opusFrameTicks
+	}
+}
+
+// Sum one frame from every ready input into sum, reporting false once there
+// are no inputs left. An input that runs short is heard as silence until it
+// has buffered up again.
+func (m *mixer) take(sum []int32) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.inputs) == 0 {
+		return false
+	}
+	clear(sum)
+	for in := range m.inputs {
+		if !in.ready {
+			continue
+		}
+		n := min(len(in.pcm), len(sum))
+		for i, v := range in.pcm[:n] {
+			sum[i] += int32(v)
+		}
+		in.pcm = in.pcm[:copy(in.pcm, in.pcm[n:])]
+		if n < len(sum) {
+			in.ready = false
+		}
+	}
+	return true
+}
+
+func (m *mixer) hasInputs() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.inputs) > 0
+}
+
+// Make a co-host the lead once the lead has gone, returning it, or nil if
+// there's nobody left. Caller must hold room.mu.
+func (room *Room) promoteCoHost() *peer {
+	for pc, p := range room.coHosts {
+		delete(room.coHosts, pc)
+		room.Broadcaster = pc
+		room.broadcasterWS = p.ws
+		room.broadcasterPeer = p
+		return p
+	}
+	return nil
+}
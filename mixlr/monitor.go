@@ -0,0 +1,25 @@
+package mixlr
+
+import "github.com/pion/webrtc/v4"
+
+// A broadcaster joining with monitor=true also gets the room's main track
+// back, exactly as listeners receive it after forwarding, so a DJ can hear
+// what the audience hears. The client adds a recvonly audio transceiver to
+// its offer for it. The monitor carries the broadcaster's own audio, so
+// it's meant for headphones: played through speakers it feeds back into
+// the mic.
+
+// Attach the room's main track to the broadcaster's connection, before its
+// first offer arrives. The sendonly transceiver pairs with the client's
+// recvonly one when the offer is applied.
+func (room *Room) attachMonitor(p *peer) error {
+	room.assignShard(p)
+	transceiver, err := p.pc.AddTransceiverFromTrack(room.mainTrackFor(p), webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		return err
+	}
+	go drainRTCP(transceiver.Sender())
+	return nil
+}
@@ -0,0 +1,91 @@
+//go:build opus
+
+package mixlr
+
+// #cgo pkg-config: opus
+// #include <opus.h>
+//
+// // opus_encoder_ctl is variadic, which cgo can't call
+// static int set_bitrate(OpusEncoder *enc, opus_int32 bitrate) {
+// 	return opus_encoder_ctl(enc, OPUS_SET_BITRATE(bitrate));
+// }
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// Opus support comes from libopus through cgo, so it's only built with
+// -tags opus (and libopus's headers installed). Without it the server still
+// forwards Opus untouched; only transcoding and mixing need the codec.
+const opusAvailable = true
+
+type opusDecoder struct {
+	dec      *C.OpusDecoder
+	channels int
+}
+
+type opusEncoder struct {
+	enc      *C.OpusEncoder
+	channels int
+}
+
+func opusError(code C.int) error {
+	return errors.New("opus: " + C.GoString(C.opus_strerror(code)))
+}
+
+func newOpusDecoder(channels int) (*opusDecoder, error) {
+	var code C.int
+	dec := C.opus_decoder_create(opusRate, C.int(channels), &code)
+	if code != C.OPUS_OK {
+		return nil, opusError(code)
+	}
+	return &opusDecoder{dec: dec, channels: channels}, nil
+}
+
+// Decode one packet into pcm (interleaved), returning samples per channel.
+// A nil packet conceals one lost frame of pcm's length.
+func (d *opusDecoder) decode(packet []byte, pcm []int16) (int, error) {
+	var data *C.uchar
+	if len(packet) > 0 {
+		data = (*C.uchar)(unsafe.Pointer(&packet[0]))
+	}
+	n := C.opus_decode(d.dec, data, C.opus_int32(len(packet)),
+		(*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/d.channels), 0)
+	if n < 0 {
+		return 0, opusError(n)
+	}
+	return int(n), nil
+}
+
+func (d *opusDecoder) close() {
+	C.opus_decoder_destroy(d.dec)
+}
+
+func newOpusEncoder(channels, bitrate int) (*opusEncoder, error) {
+	var code C.int
+	enc := C.opus_encoder_create(opusRate, C.int(channels), C.OPUS_APPLICATION_AUDIO, &code)
+	if code != C.OPUS_OK {
+		return nil, opusError(code)
+	}
+	if code = C.set_bitrate(enc, C.opus_int32(bitrate)); code != C.OPUS_OK {
+		C.opus_encoder_destroy(enc)
+		return nil, opusError(code)
+	}
+	return &opusEncoder{enc: enc, channels: channels}, nil
+}
+
+// Encode one frame of interleaved pcm into out, returning the packet length
+func (e *opusEncoder) encode(pcm []int16, out []byte) (int, error) {
+	n := C.opus_encode(e.enc, (*C.opus_int16)(unsafe.Pointer(&pcm[0])), C.int(len(pcm)/e.channels),
+		(*C.uchar)(unsafe.Pointer(&out[0])), C.opus_int32(len(out)))
+	if n < 0 {
+		return 0, opusError(C.int(n))
+	}
+	return int(n), nil
+}
+
+func (e *opusEncoder) close() {
+	C.opus_encoder_destroy(e.enc)
+}
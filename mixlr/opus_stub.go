@@ -0,0 +1,35 @@
+//go:build !opus
+
+package mixlr
+
+import "errors"
+
+// Built without -tags opus: no codec, so audio_mode=transcode and
+// max_broadcasters above 1 are refused at /create (see opus.go)
+const opusAvailable = false
+
+var errNoOpus = errors.New("opus: server built without -tags opus")
+
+type opusDecoder struct{}
+
+type opusEncoder struct{}
+
+func newOpusDecoder(channels int) (*opusDecoder, error) {
+	return nil, errNoOpus
+}
+
+func (d *opusDecoder) decode(packet []byte, pcm []int16) (int, error) {
+	return 0, errNoOpus
+}
+
+func (d *opusDecoder) close() {}
+
+func newOpusEncoder(channels, bitrate int) (*opusEncoder, error) {
+	return nil, errNoOpus
+}
+
+func (e *opusEncoder) encode(pcm []int16, out []byte) (int, error) {
+	return 0, errNoOpus
+}
+
+func (e *opusEncoder) close() {}
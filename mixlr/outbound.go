@@ -0,0 +1,87 @@
+package mixlr
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Icecast and webhook URLs make the server connect wherever a room's
+// creator says, which left open would let anyone reach hosts on the
+// server's own network. Only admins may set them, unless the host is in
+// Options.OutboundHosts, and every such connection refuses loopback,
+// private and link-local addresses whatever the hostname resolved to.
+
+var errBlockedAddress = errors.New("must not point at a loopback, private or link-local address")
+
+func blockedAddr(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// Refuse to connect to a blocked address, checked after DNS so a public
+// name for a private address gets nowhere
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || blockedAddr(ip) {
+		return fmt.Errorf("%s: %w", host, errBlockedAddress)
+	}
+	return nil
+}
+
+// A client for room-supplied URLs. Proxy settings are ignored, since the
+// dial check has to see the real destination.
+func outboundClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Control: dialControl}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+}
+
+// Field errors for the URLs (option name → value) the request may not set
+func (s *Server) checkOutbound(r *http.Request, urls map[string]string) optionErrors {
+	errs := optionErrors{}
+	for field, raw := range urls {
+		if err := s.outboundAllowed(r, raw); err != nil {
+			errs[field] = err.Error()
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (s *Server) outboundAllowed(r *http.Request, raw string) error {
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil && blockedAddr(ip) {
+		return errBlockedAddress
+	}
+	if s.isAdmin(r) || slices.ContainsFunc(s.opts.OutboundHosts, func(h string) bool {
+		return strings.EqualFold(h, host)
+	}) {
+		return nil
+	}
+	return errors.New("needs the admin token, as " + host + " is not an allowed host")
+}
@@ -0,0 +1,121 @@
+package mixlr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// Outgoing packets queued per stream before the pacer starts dropping
+const pacerQueueSize = 64
+
+// Sender-side pacer: outgoing RTP on each stream is spaced at least gap
+// apart, so a burst from the broadcaster (say, a backlog flushed after a
+// network stall) leaves as a steady stream instead of one spike.
+//
+// The cost is latency: the last packet of an N-packet burst goes out
+// (N-1)*gap later than it would have. Steady 20ms audio is never delayed
+// as long as gap stays below the frame interval.
+type pacerFactory struct {
+	gap time.Duration
+}
+
+func (f *pacerFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &pacer{gap: f.gap, streams: make(map[uint32]*pacedStream)}, nil
+}
+
+type pacedPacket struct {
+	header     rtp.Header
+	payload    []byte
+	attributes interceptor.Attributes
+}
+
+type pacedStream struct {
+	mu     sync.Mutex
+	queue  chan pacedPacket
+	closed bool
+}
+
+func (s *pacedStream) enqueue(pkt pacedPacket) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- pkt:
+	default:
+		// Queue full: the link can't keep up anyway, drop rather than block the fanout
+	}
+}
+
+func (s *pacedStream) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+}
+
+type pacer struct {
+	interceptor.NoOp
+	gap time.Duration
+
+	mu      sync.Mutex
+	streams map[uint32]*pacedStream
+}
+
+func (p *pacer) BindLocalStream(info *interceptor.StreamInfo, writer interceptor.RTPWriter) interceptor.RTPWriter {
+	stream := &pacedStream{queue: make(chan pacedPacket, pacerQueueSize)}
+	p.mu.Lock()
+	p.streams[info.SSRC] = stream
+	p.mu.Unlock()
+
+	go func() {
+		defer recoverPanic("pacer", nil)
+		var last time.Time
+		for pkt := range stream.queue {
+			if wait := p.gap - time.Since(last); wait > 0 {
+				time.Sleep(wait)
+			}
+			last = time.Now()
+			writer.Write(&pkt.header, pkt.payload, pkt.attributes)
+		}
+	}()
+
+	return interceptor.RTPWriterFunc(func(header *rtp.Header, payload []byte, attributes interceptor.Attributes) (int, error) {
+		// The caller reuses its buffers once we return
+		stream.enqueue(pacedPacket{
+			header:     header.Clone(),
+			payload:    append([]byte(nil), payload...),
+			attributes: attributes,
+		})
+		return header.MarshalSize() + len(payload), nil
+	})
+}
+
+func (p *pacer) UnbindLocalStream(info *interceptor.StreamInfo) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if stream, ok := p.streams[info.SSRC]; ok {
+		stream.close()
+		delete(p.streams, info.SSRC)
+	}
+}
+
+func (p *pacer) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for ssrc, stream := range p.streams {
+		stream.close()
+		delete(p.streams, ssrc)
+	}
+	return nil
+}
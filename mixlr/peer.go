@@ -0,0 +1,219 @@
+package mixlr
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	roleBroadcaster = "broadcaster"
+	roleListener    = "listener"
+	// A listener that may also control the room (mute, etc.)
+	roleModerator = "moderator"
+)
+
+// One signaling connection and the peer connection it negotiates
+type peer struct {
+	pc   *webrtc.PeerConnection
+	ws   *signalConn
+	role string
+
+	// Short random ID users can quote in bug reports
+	id       string
+	joinedAt time.Time
+	// Set when an Authenticator is configured
+	identity *Identity
+	// Client IP, as resolved through trusted proxies
+	ip string
+	// Optional display name for chat and presence; set_name changes it
+	name atomic.Pointer[string]
+
+	// Unix nanos of the last signaling message received
+	lastActive atomic.Int64
+
+	// ICE path ("direct" or "relay") this peer is counted under in metrics
+	path atomic.Pointer[string]
+
+	// Listeners: room tracks attached to this peer by name, and the ones
+	// it opted out of. Guarded by room.mu (see tracks.go).
+	senders      map[string]*webrtc.RTPSender
+	unsubscribed map[string]bool
+
+	// Listeners: which shard of the main room track this one gets
+	shard int
+	// Listeners: the server-created metadata data channel
+	metadata *webrtc.DataChannel
+	// Listeners: the room currently being listened to, which changes on
+	// migrate (see migrate.go)
+	room atomic.Pointer[Room]
+	// Drops packets until connected (see gate.go)
+	gate *sendGate
+
+	// Last quality score sent (0 = none yet)
+	quality atomic.Int32
+
+	// Set when reattaching is enabled (see session.go)
+	session *session
+	// Closed once the peer connection has closed or failed
+	pcGone   chan struct{}
+	goneOnce sync.Once
+
+	// Listeners: reads RTCP for a main-track sender attached after joining,
+	// as the first one's reader ends with it (see bandwidth.go)
+	readRTCP func(sender *webrtc.RTPSender)
+
+	// Broadcasters: closed when the first audio track arrives
+	firstTrack     chan struct{}
+	firstTrackOnce sync.Once
+
+	// Put every ICE candidate in our SDP instead of trickling them (see
+	// trickle.go)
+	gatherFirst bool
+
+	// Serializes server-initiated offers
+	negotiateMu sync.Mutex
+	// Negotiation generation: for listeners the seq on the latest offer we
+	// sent, for broadcasters the highest seq on theirs (see staleSDP)
+	sdpSeq atomic.Uint32
+	// Whether a broadcaster offer with a seq has been applied yet; only
+	// touched by the signaling read loop
+	sdpSeqSeen bool
+}
+
+func (p *peer) markGone() {
+	p.goneOnce.Do(func() { close(p.pcGone) })
+}
+
+func (p *peer) displayName() string {
+	if name := p.name.Load(); name != nil {
+		return *name
+	}
+	return ""
+}
+
+// A display name trimmed and checked for length and control characters
+func cleanName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if err := checkText(name, maxNameLen, false); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Validate and set the display name ("" clears it)
+func (p *peer) setName(name string) error {
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	p.name.Store(&name)
+	return nil
+}
+
+func (p *peer) markFirstTrack() {
+	p.firstTrackOnce.Do(func() { close(p.firstTrack) })
+}
+
+// Send the listener a fresh offer
+func (p *peer) offer(room *Room) error {
+	return p.offerWith(room, false)
+}
+
+// Offer, optionally with fresh ICE credentials (see restartICE)
+func (p *peer) offerWith(room *Room, iceRestart bool) error {
+	p.negotiateMu.Lock()
+	defer p.negotiateMu.Unlock()
+	options := room.offerOptions()
+	options.ICERestart = iceRestart
+	return sendOffer(p.ws, p.pc, options, p.sdpSeq.Add(1), p.gatherFirst)
+}
+
+// Re-offer after the listener's tracks changed
+func (p *peer) renegotiate(room *Room) {
+	if err := p.offer(room); err != nil {
+		log.Println("Renegotiation error:", err)
+	}
+}
+
+// Record client activity, for idle disconnects
+func (p *peer) touch() {
+	p.lastActive.Store(time.Now().UnixNano())
+}
+
+// Close the connection once it has gone idle for longer than idle, or has
+// been open longer than maxDuration (either 0 disables it). Returns when
+// done is closed.
+func (p *peer) watchIdle(idle, maxDuration time.Duration, done <-chan struct{}) {
+	p.touch()
+	for {
+		now := time.Now()
+		var deadline time.Time
+		reason := ""
+		if idle > 0 {
+			deadline = time.Unix(0, p.lastActive.Load()).Add(idle)
+			reason = "idle"
+		}
+		if end := p.joinedAt.Add(maxDuration); maxDuration > 0 && (deadline.IsZero() || end.Before(deadline)) {
+			deadline = end
+			reason = "max_duration"
+		}
+
+		if !now.Before(deadline) {
+			log.Printf("Disconnecting %s %s (%s)", p.role, p.id, reason)
+			p.ws.WriteJSON(map[string]string{"type": "idle_disconnect", "reason": reason})
+			p.ws.CloseWith(websocket.CloseNormalClosure, "Disconnected: "+reason)
+			return
+		}
+
+		timer := time.NewTimer(deadline.Sub(now))
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+			// Activity may have pushed the deadline out; recheck
+		}
+	}
+}
+
+func (p *peer) canModerate() bool {
+	return p.role == roleBroadcaster || p.role == roleModerator
+}
+
+// Connection details for {"type":"whoami"}
+func (p *peer) whoami(room string) map[string]any {
+	info := map[string]any{
+		"type":      "whoami",
+		"id":        p.id,
+		"room":      room,
+		"role":      p.role,
+		"joined_at": p.joinedAt.UTC().Format(time.RFC3339),
+	}
+	// Candidate types of the pair ICE settled on, from the client's side:
+	// "candidate" is theirs, "server_candidate" is ours
+	if pair := p.selectedPair(); pair != nil {
+		info["candidate"] = pair.Remote.Typ.String()
+		info["server_candidate"] = pair.Local.Typ.String()
+	}
+	return info
+}
+
+// The ICE candidate pair in use, or nil before ICE has settled
+func (p *peer) selectedPair() *webrtc.ICECandidatePair {
+	for _, t := range p.pc.GetTransceivers() {
+		if t.Sender() == nil || t.Sender().Transport() == nil {
+			continue
+		}
+		pair, err := t.Sender().Transport().ICETransport().GetSelectedCandidatePair()
+		if err == nil && pair != nil {
+			return pair
+		}
+	}
+	return nil
+}
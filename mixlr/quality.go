@@ -0,0 +1,121 @@
+package mixlr
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// Limits for a 1–5 connection quality score. Each metric scores 5 at or
+// below its first limit and one less for each limit it exceeds; the
+// listener's score is the worst of the three.
+type QualityThresholds struct {
+	Loss   [4]float64 // fraction of packets lost
+	Jitter [4]time.Duration
+	RTT    [4]time.Duration
+}
+
+var DefaultQualityThresholds = QualityThresholds{
+	Loss:   [4]float64{0.01, 0.03, 0.08, 0.15},
+	Jitter: [4]time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond, 150 * time.Millisecond},
+	RTT:    [4]time.Duration{150 * time.Millisecond, 300 * time.Millisecond, 500 * time.Millisecond, 800 * time.Millisecond},
+}
+
+// Parse comma-separated limits, e.g. QUALITY_LOSS="0.01,0.03,0.08,0.15" and
+// QUALITY_JITTER/QUALITY_RTT="20ms,40ms,80ms,150ms". Empty keeps the default.
+func ParseQualityThresholds(loss, jitter, rtt string) (QualityThresholds, error) {
+	t := DefaultQualityThresholds
+	if loss != "" {
+		fields, err := fourFields("loss", loss)
+		if err != nil {
+			return t, err
+		}
+		for i, f := range fields {
+			if t.Loss[i], err = strconv.ParseFloat(f, 64); err != nil {
+				return t, fmt.Errorf("invalid quality loss limit %q", f)
+			}
+		}
+	}
+	for _, d := range []struct {
+		name   string
+		value  string
+		limits *[4]time.Duration
+	}{{"jitter", jitter, &t.Jitter}, {"rtt", rtt, &t.RTT}} {
+		if d.value == "" {
+			continue
+		}
+		fields, err := fourFields(d.name, d.value)
+		if err != nil {
+			return t, err
+		}
+		for i, f := range fields {
+			if d.limits[i], err = time.ParseDuration(f); err != nil {
+				return t, fmt.Errorf("invalid quality %s limit %q", d.name, f)
+			}
+		}
+	}
+	return t, nil
+}
+
+func fourFields(name, s string) ([]string, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("quality %s needs 4 comma-separated limits, got %q", name, s)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return fields, nil
+}
+
+func scoreAgainst[T float64 | time.Duration](value T, limits [4]T) int {
+	score := 5
+	for _, limit := range limits {
+		if value > limit {
+			score--
+		}
+	}
+	return score
+}
+
+// Score a listener from one RTCP reception report. rtt is 0 when the
+// report can't yield one (no sender report seen yet).
+func (t *QualityThresholds) score(loss float64, jitter, rtt time.Duration) int {
+	return min(
+		scoreAgainst(loss, t.Loss),
+		scoreAgainst(jitter, t.Jitter),
+		scoreAgainst(rtt, t.RTT),
+	)
+}
+
+// Loss, jitter and round-trip time from a listener's reception report on
+// our stream. RTT comes from the LSR/DLSR echo of our sender reports.
+func reportStats(r rtcp.ReceptionReport, clockRate uint32, now time.Time) (loss float64, jitter, rtt time.Duration) {
+	loss = float64(r.FractionLost) / 256
+	jitter = time.Duration(float64(r.Jitter) / float64(clockRate) * float64(time.Second))
+	if r.LastSenderReport != 0 {
+		// All three are the middle 32 bits of NTP time, in 1/65536 s
+		elapsed := ntpMiddle(now) - r.LastSenderReport - r.Delay
+		rtt = time.Duration(float64(elapsed) / 65536 * float64(time.Second))
+	}
+	return loss, jitter, rtt
+}
+
+// Seconds since 1900 in 16.16 fixed point, as used by LSR/DLSR
+func ntpMiddle(t time.Time) uint32 {
+	const ntpEpochOffset = 2208988800
+	secs := uint64(t.Unix()+ntpEpochOffset) << 16
+	frac := uint64(t.Nanosecond()) << 16 / uint64(time.Second)
+	return uint32(secs | frac)
+}
+
+// Push the listener's score when it changes
+func (p *peer) reportQuality(score int) {
+	if p.quality.Swap(int32(score)) == int32(score) {
+		return
+	}
+	p.ws.WriteJSON(map[string]any{"type": "quality", "score": score})
+}
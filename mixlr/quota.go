@@ -0,0 +1,56 @@
+package mixlr
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// With an Authenticator, Options.MaxRoomsPerUser caps how many rooms one
+// identity can have at once, so a single account can't take over the
+// server. Rooms count against whoever created them until they're removed;
+// anonymous and seeded rooms aren't counted. A room is removed when its
+// reservation lapses or it sits idle for Options.RoomIdleTimeout (see
+// cleanup.go), which is why the quota needs that timeout set.
+
+// The key a room counts under, or "" if it doesn't count
+func quotaOwner(id *Identity) string {
+	if id == nil {
+		return ""
+	}
+	return id.Subject
+}
+
+// Whether the room's creator may have another room. Caller must hold
+// s.roomsMu.
+func (s *Server) underQuota(room *Room) bool {
+	owner := quotaOwner(room.creator)
+	return owner == "" || s.opts.MaxRoomsPerUser <= 0 || s.roomsByOwner[owner] < s.opts.MaxRoomsPerUser
+}
+
+// Caller must hold s.roomsMu
+func (s *Server) countRoom(room *Room, delta int) {
+	owner := quotaOwner(room.creator)
+	if owner == "" {
+		return
+	}
+	s.roomsByOwner[owner] += delta
+	if s.roomsByOwner[owner] <= 0 {
+		delete(s.roomsByOwner, owner)
+	}
+}
+
+// Remove a room from the server. Caller must hold s.roomsMu.
+func (s *Server) removeRoom(room *Room) {
+	delete(s.rooms, room.Name)
+	s.countRoom(room, -1)
+}
+
+func writeQuotaExceeded(w http.ResponseWriter, limit int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":   "room_quota_exceeded",
+		"message": "You already have the maximum number of rooms",
+		"limit":   limit,
+	})
+}
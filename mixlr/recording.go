@@ -0,0 +1,214 @@
+package mixlr
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// One 20ms Opus frame at 48kHz, in RTP timestamp ticks and so in samples per
+// channel too
+const opusFrameTicks = 960
+
+// Recording formats, chosen per room with record_format
+const (
+	// Ogg/Opus, for playback
+	recordOgg = "ogg"
+	// Raw packets in rtpdump format (see rtpdump.go), for analysis and replay
+	recordRTPDump = "rtpdump"
+)
+
+// Where a recording's packets go; one implementation per format
+type recordingWriter interface {
+	WriteRTP(pkt *rtp.Packet) error
+	Close() error
+}
+
+// Archive of a room. It belongs to the room rather than the broadcaster,
+// so a broadcaster who drops and reconnects within the grace period keeps
+// appending to the same file.
+type recording struct {
+	mu   sync.Mutex
+	path string
+	out  recordingWriter
+
+	// Offset applied to packet timestamps so the file's granule positions
+	// run on without the reconnect gap
+	started bool
+	rejoin  bool
+	lastTS  uint32
+	offset  uint32
+
+	// Guarded by room.mu: bumped on every broadcaster change, so a grace
+	// timer only fires if nothing happened since it was set
+	generation int
+}
+
+func newRecording(dir, room, format string, channels uint16) (*recording, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = recordOgg
+	}
+	name := fmt.Sprintf("%s-%s.%s", room, time.Now().UTC().Format("20060102T150405Z"), format)
+	path := filepath.Join(dir, name)
+
+	var out recordingWriter
+	var err error
+	switch format {
+	case recordOgg:
+		out, err = oggwriter.New(path, 48000, channels)
+	case recordRTPDump:
+		out, err = newRTPDumpWriter(path)
+	default:
+		err = fmt.Errorf("unknown recording format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &recording{path: path, out: out}, nil
+}
+
+func (rec *recording) write(pkt *rtp.Packet) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.out == nil {
+		return
+	}
+	ts := pkt.Timestamp + rec.offset
+	if rec.rejoin {
+		// First packet after a reconnect lands one frame after the last
+		rec.offset += rec.lastTS + opusFrameTicks - ts
+		ts = rec.lastTS + opusFrameTicks
+		rec.rejoin = false
+	}
+	rec.started = true
+	rec.lastTS = ts
+
+	out := *pkt
+	out.Timestamp = ts
+	if err := rec.out.WriteRTP(&out); err != nil {
+		log.Printf("Recording %s write error: %v", rec.path, err)
+	}
+}
+
+// Audio is about to pick up after a gap: a new broadcaster, or listeners
+// back in a RecordWhenListened room
+func (rec *recording) resume() {
+	rec.mu.Lock()
+	rec.rejoin = rec.started
+	rec.mu.Unlock()
+}
+
+func (rec *recording) close() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	if rec.out == nil {
+		return
+	}
+	if err := rec.out.Close(); err != nil {
+		log.Printf("Recording %s close error: %v", rec.path, err)
+	}
+	rec.out = nil
+	log.Printf("Recording %s finished", rec.path)
+}
+
+// Feeds a RecordWhenListened recording only while the room has listeners.
+// Each stretch is stitched on to the last as after a broadcaster
+// reconnect, so the file holds only audio someone heard, without gaps.
+type listenedRecording struct {
+	room *Room
+	rec  *recording
+	// Only touched by the forwarding goroutine
+	idle bool
+}
+
+// The sink the broadcaster's audio should go to for rec
+func (room *Room) recordingSink(rec *recording) packetSink {
+	if !room.RecordWhenListened {
+		return rec
+	}
+	return &listenedRecording{room: room, rec: rec}
+}
+
+func (l *listenedRecording) write(pkt *rtp.Packet) {
+	if l.room.listenerCount.Load() == 0 {
+		if !l.idle {
+			log.Printf("Recording %s paused with no listeners", l.rec.path)
+			l.idle = true
+		}
+		return
+	}
+	if l.idle {
+		log.Printf("Recording %s picked up again for a listener", l.rec.path)
+		l.rec.resume()
+		l.idle = false
+	}
+	l.rec.write(pkt)
+}
+
+// Start the room's recording, or pick up the one a previous broadcaster
+// left within the grace period
+func (room *Room) resumeRecording(dir string) (*recording, error) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if rec := room.recording; rec != nil {
+		rec.generation++
+		rec.resume()
+		log.Printf("Recording %s resumed", rec.path)
+		return rec, nil
+	}
+
+	rec, err := newRecording(dir, room.Name, room.RecordFormat, room.channels())
+	if err != nil {
+		return nil, err
+	}
+	room.recording = rec
+	log.Printf("Recording room %s to %s", room.Name, rec.path)
+	return rec, nil
+}
+
+// The broadcaster is gone; finish the recording unless one returns within grace
+func (room *Room) suspendRecording(grace time.Duration) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	rec := room.recording
+	if rec == nil {
+		return
+	}
+	rec.generation++
+	generation := rec.generation
+	time.AfterFunc(grace, func() {
+		room.mu.Lock()
+		if room.recording != rec || rec.generation != generation {
+			room.mu.Unlock()
+			return
+		}
+		room.recording = nil
+		room.mu.Unlock()
+		rec.close()
+	})
+}
+
+// Finish the recording now, e.g. on shutdown
+func (room *Room) stopRecording() {
+	room.mu.Lock()
+	rec := room.recording
+	room.recording = nil
+	room.mu.Unlock()
+
+	if rec != nil {
+		rec.close()
+	}
+}
@@ -0,0 +1,22 @@
+package mixlr
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// Deferred at the top of goroutines and callbacks we own, so a panic (say
+// on a malformed packet) ends that connection instead of the process.
+// where says which room/peer it was, for the log; cleanup, if set, tears
+// down whatever the goroutine was responsible for. Must be deferred
+// directly for recover to see the panic.
+func recoverPanic(where string, cleanup func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	log.Printf("Panic in %s: %v\n%s", where, r, debug.Stack())
+	if cleanup != nil {
+		cleanup()
+	}
+}
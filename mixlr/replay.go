@@ -0,0 +1,246 @@
+package mixlr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+// A recording being played back into a room in place of a live
+// broadcaster. It feeds the room track exactly as a broadcaster's audio
+// would, paced by the file's granule positions. A broadcaster who starts
+// sending takes over from it.
+//
+// Only Ogg/Opus files with one packet per page are supported, which is how
+// recordings made by this server are written.
+type replay struct {
+	file string
+	loop bool
+	// Closed to stop playback; done is closed once it has
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Body of POST /rooms/{id}/replay. File is a recording's name within
+// Options.RecordingDir.
+type replayRequest struct {
+	File string `json:"file"`
+	Loop bool   `json:"loop"`
+}
+
+// Handle POST /rooms/{id}/replay: start playing a recording into the room
+func (s *Server) startReplay(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+	room, ok := s.lookupRoom(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if s.opts.RecordingDir == "" {
+		http.Error(w, "Recording is not enabled on this server", http.StatusNotFound)
+		return
+	}
+
+	var req replayRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxOptionsBody)).Decode(&req); err != nil {
+		http.Error(w, "Body must be a JSON object with a file", http.StatusBadRequest)
+		return
+	}
+	// A bare file name, so nothing outside the recording directory
+	if req.File == "" || req.File != filepath.Base(req.File) || !strings.HasSuffix(req.File, "."+recordOgg) {
+		http.Error(w, "file must be the name of an .ogg recording", http.StatusBadRequest)
+		return
+	}
+	f, err := os.Open(filepath.Join(s.opts.RecordingDir, req.File))
+	if err != nil {
+		http.Error(w, "Recording not found", http.StatusNotFound)
+		return
+	}
+	reader, _, err := oggreader.NewWith(f)
+	if err != nil {
+		f.Close()
+		http.Error(w, "Not an Ogg/Opus file", http.StatusBadRequest)
+		return
+	}
+
+	rp := &replay{
+		file: req.File,
+		loop: req.Loop,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	room.mu.Lock()
+	if room.mainLive {
+		room.mu.Unlock()
+		f.Close()
+		http.Error(w, "Room is already live", http.StatusConflict)
+		return
+	}
+	room.mainLive = true
+	room.replay = rp
+	started := room.StartedAt.IsZero()
+	if started {
+		room.StartedAt = time.Now()
+	}
+	room.mu.Unlock()
+
+	log.Printf("Replaying %s into room %s (loop %t)", req.File, room.Name, req.Loop)
+	if started {
+		room.publish(roomEvent{Type: eventBroadcasterStarted})
+	}
+	room.broadcast(map[string]any{"type": "replay_started", "file": req.File, "loop": req.Loop})
+	go room.runReplay(rp, f, reader)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]any{"room": room.Name, "file": req.File, "loop": req.Loop})
+}
+
+// Handle DELETE /rooms/{id}/replay
+func (s *Server) stopReplay(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+	room, ok := s.lookupRoom(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	if !room.stopReplay() {
+		http.Error(w, "No replay running", http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stop the room's replay, if any, and wait for it to let go of the room
+// track. Returns false if nothing was playing.
+func (room *Room) stopReplay() bool {
+	room.mu.Lock()
+	rp := room.replay
+	if rp != nil {
+		select {
+		case <-rp.stop:
+		default:
+			close(rp.stop)
+		}
+	}
+	room.mu.Unlock()
+
+	if rp == nil {
+		return false
+	}
+	<-rp.done
+	return true
+}
+
+func (room *Room) runReplay(rp *replay, f *os.File, reader *oggreader.OggReader) {
+	defer recoverPanic("replay of "+rp.file+" in room "+room.Name, nil)
+	defer func() {
+		f.Close()
+		room.mu.Lock()
+		room.replay = nil
+		room.mainLive = false
+		if room.Broadcaster == nil {
+			room.StartedAt = time.Time{}
+		}
+		room.mu.Unlock()
+		if room.primer != nil {
+			room.primer.reset()
+		}
+		close(rp.done)
+		log.Printf("Replay of %s in room %s ended", rp.file, room.Name)
+		room.broadcast(map[string]string{"type": "replay_ended", "file": rp.file})
+	}()
+
+	fw := room.newFanoutWriter()
+	defer fw.close()
+
+	var (
+		seq         uint16
+		lastGranule uint64
+		first       = true
+		// Wall-clock time the next packet is due
+		due = time.Now()
+		// Audio packets sent since the file last started over
+		sent int
+	)
+	for {
+		select {
+		case <-rp.stop:
+			return
+		default:
+		}
+
+		payload, page, err := reader.ParseNextPage()
+		if errors.Is(err, io.EOF) && rp.loop {
+			// A file with nothing but headers (a track that ended before
+			// its first packet) would otherwise loop flat out forever
+			if sent == 0 {
+				log.Printf("Replay of %s: no audio to loop", rp.file)
+				return
+			}
+			sent = 0
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				log.Printf("Replay of %s: %v", rp.file, err)
+				return
+			}
+			reader.ResetReader(func(int64) io.Reader { return f })
+			lastGranule = 0
+			first = true
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				log.Printf("Replay of %s: %v", rp.file, err)
+			}
+			return
+		}
+		// The headers come round again on every loop
+		if bytes.HasPrefix(payload, []byte("OpusHead")) || bytes.HasPrefix(payload, []byte("OpusTags")) {
+			continue
+		}
+
+		// Granule positions count 48kHz samples to the end of the page
+		duration := page.GranulePosition - lastGranule
+		if page.GranulePosition < lastGranule || duration > 48000 {
+			duration = opusFrameTicks
+		}
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				SequenceNumber: seq,
+				Timestamp:      uint32(lastGranule),
+			},
+			Payload: payload,
+		}
+		seq++
+		lastGranule = page.GranulePosition
+
+		select {
+		case <-rp.stop:
+			return
+		case <-time.After(time.Until(due)):
+		}
+		due = due.Add(time.Duration(duration) * time.Second / 48000)
+
+		if first {
+			room.rewriter.rebase(pkt, 48000)
+			first = false
+		}
+		room.relay(pkt, fw, nil)
+		sent++
+	}
+}
@@ -0,0 +1,127 @@
+package mixlr
+
+import (
+	"log"
+	"time"
+)
+
+// Listeners can tell us something sounds wrong with
+// {"type":"report","issue":"no_audio"|"choppy"|"delay"}. One report could be
+// the listener's own network; several at once point at the broadcaster or
+// at us. Reports are logged with the listener's stats and counted per
+// room over reportWindow, one per listener per issue. Once enough
+// listeners agree, the broadcaster and moderators get
+// {"type":"listener_reports","issue":...,"count":n,"listeners":total}, at
+// most once per window for each issue.
+var reportIssues = map[string]bool{
+	"no_audio": true,
+	"choppy":   true,
+	"delay":    true,
+}
+
+const (
+	reportWindow = time.Minute
+	// Distinct reporters needed to notify, unless half the room agrees
+	// first
+	reportNotifyMin = 3
+)
+
+// Recent reports in a room. Guarded by room.mu.
+type roomReports struct {
+	// issue → listener ID → when it last reported it
+	byIssue map[string]map[string]time.Time
+	// issue → when the broadcaster was last told
+	notified map[string]time.Time
+}
+
+// Count reporters of issue within the window, dropping older reports.
+// Caller must hold room.mu.
+func (rr *roomReports) count(issue string, now time.Time) int {
+	for id, at := range rr.byIssue[issue] {
+		if now.Sub(at) > reportWindow {
+			delete(rr.byIssue[issue], id)
+		}
+	}
+	return len(rr.byIssue[issue])
+}
+
+// Record a listener's report and notify the room's moderators if it tips
+// the issue over the threshold. Repeats from the same listener within the
+// window are ignored.
+func (room *Room) report(p *peer, issue string) {
+	now := time.Now()
+
+	room.mu.Lock()
+	rr := &room.reports
+	if rr.byIssue == nil {
+		rr.byIssue = make(map[string]map[string]time.Time)
+		rr.notified = make(map[string]time.Time)
+	}
+	if rr.byIssue[issue] == nil {
+		rr.byIssue[issue] = make(map[string]time.Time)
+	}
+	if at, ok := rr.byIssue[issue][p.id]; ok && now.Sub(at) <= reportWindow {
+		room.mu.Unlock()
+		return
+	}
+	rr.byIssue[issue][p.id] = now
+	count := rr.count(issue, now)
+	listeners := len(room.Listeners)
+	notify := (count >= reportNotifyMin || count*2 >= listeners) && now.Sub(rr.notified[issue]) > reportWindow
+	if notify {
+		rr.notified[issue] = now
+	}
+	room.mu.Unlock()
+
+	candidate := "unknown"
+	if pair := p.selectedPair(); pair != nil {
+		candidate = pair.Remote.Typ.String()
+	}
+	log.Printf("Listener %s in room %s reports %s (quality %d, candidate %s)",
+		p.id, room.Name, issue, p.quality.Load(), candidate)
+
+	if !notify {
+		return
+	}
+	log.Printf("Room %s: %d of %d listeners report %s", room.Name, count, listeners, issue)
+	room.tellModerators(map[string]any{
+		"type":      "listener_reports",
+		"issue":     issue,
+		"count":     count,
+		"listeners": listeners,
+	})
+}
+
+// Reporters per issue within the window, for room_state. Caller must hold
+// room.mu.
+func (room *Room) reportCounts() map[string]int {
+	counts := make(map[string]int)
+	now := time.Now()
+	for issue, reporters := range room.reports.byIssue {
+		n := 0
+		for _, at := range reporters {
+			if now.Sub(at) <= reportWindow {
+				n++
+			}
+		}
+		if n > 0 {
+			counts[issue] = n
+		}
+	}
+	return counts
+}
+
+// Send a message to the broadcaster and any moderators
+func (room *Room) tellModerators(msg any) {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	if room.broadcasterWS != nil {
+		room.broadcasterWS.WriteJSON(msg)
+	}
+	for _, p := range room.Listeners {
+		if p.canModerate() {
+			p.ws.WriteJSON(msg)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package mixlr
+
+import (
+	"log"
+	"time"
+)
+
+// A room created with reserved=true is being held for a scheduled show. If
+// no broadcaster has joined it within Options.ReservationWindow it's
+// removed, so rooms provisioned for shows that never happen don't pile up.
+
+// Start the room's reservation clock. Called from addRoom.
+func (s *Server) reserve(room *Room) {
+	if !room.Reserved || s.opts.ReservationWindow <= 0 {
+		return
+	}
+	room.mu.Lock()
+	room.reservedUntil = time.Now().Add(s.opts.ReservationWindow)
+	room.mu.Unlock()
+	time.AfterFunc(s.opts.ReservationWindow, func() { s.expireReservation(room) })
+}
+
+// Remove the room if nobody has claimed it. Anyone still connected (a
+// listener waiting for the show) keeps it alive.
+func (s *Server) expireReservation(room *Room) {
+	s.roomsMu.Lock()
+	defer s.roomsMu.Unlock()
+
+	room.mu.Lock()
+	unused := !room.claimed && room.Broadcaster == nil && len(room.Listeners) == 0
+	room.reservedUntil = time.Time{}
+	room.mu.Unlock()
+	if !unused || s.rooms[room.Name] != room {
+		return
+	}
+
+	s.removeRoom(room)
+	log.Printf("Reserved room %s expired without a broadcaster", room.Name)
+	room.publish(roomEvent{Type: eventRoomExpired})
+}
+
+// A broadcaster has joined, so the reservation has served its purpose.
+// Caller must hold room.mu.
+func (room *Room) claim() {
+	room.claimed = true
+	room.reservedUntil = time.Time{}
+}
@@ -0,0 +1,67 @@
+package mixlr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Keeps the room's outgoing RTP one continuous stream across broadcaster
+// changes. A new broadcaster starts at random sequence numbers, which can
+// land behind the old ones and be dropped by the listeners' SRTP replay
+// protection, so each source is rebased onto where the last one stopped.
+//
+// SSRCs need no rewriting here: pion stamps each listener's binding of a
+// TrackLocalStaticRTP with that sender's own SSRC on every write, so no
+// two listeners share one and none sees the broadcaster's.
+type rtpRewriter struct {
+	mu sync.Mutex
+
+	started   bool
+	lastSeq   uint16
+	lastTS    uint32
+	lastWrite time.Time
+
+	seqOffset uint16
+	tsOffset  uint32
+}
+
+// Start a new source; its first packet continues from the previous one
+func (rw *rtpRewriter) rebase(pkt *rtp.Packet, clockRate uint32) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	if !rw.started {
+		rw.seqOffset, rw.tsOffset = 0, 0
+		return
+	}
+	// Advance the timestamp by the wall-clock gap so playout timing holds
+	gap := uint32(time.Since(rw.lastWrite).Seconds() * float64(clockRate))
+	if gap == 0 {
+		gap = 1
+	}
+	rw.seqOffset = rw.lastSeq + 1 - pkt.SequenceNumber
+	rw.tsOffset = rw.lastTS + gap - pkt.Timestamp
+}
+
+func (rw *rtpRewriter) rewrite(pkt *rtp.Packet) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	pkt.SequenceNumber += rw.seqOffset
+	pkt.Timestamp += rw.tsOffset
+	rw.started = true
+	rw.lastSeq = pkt.SequenceNumber
+	rw.lastTS = pkt.Timestamp
+	rw.lastWrite = time.Now()
+}
+
+// A packet was dropped on purpose (e.g. muted); close the sequence gap so
+// listeners don't see it as loss
+func (rw *rtpRewriter) skip() {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+
+	rw.seqOffset--
+}
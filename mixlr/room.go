@@ -0,0 +1,735 @@
+package mixlr
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+type Room struct {
+	Name        string
+	Broadcaster *webrtc.PeerConnection
+	Listeners   map[*webrtc.PeerConnection]*peer
+	mu          sync.RWMutex
+
+	// Signaling socket of the current broadcaster, for server → DJ events
+	broadcasterWS *signalConn
+	// And the rest of its connection, for the sessions endpoints
+	broadcasterPeer *peer
+
+	// Broadcasters allowed at once; above 1 their audio is mixed, mixer is
+	// set, and everyone after the lead is a co-host (see mixer.go)
+	MaxBroadcasters int
+	mixer           *mixer
+	coHosts         map[*webrtc.PeerConnection]*peer
+
+	// Optional secrets; empty means the role is open to anyone
+	BroadcasterToken   string
+	ListenerPassphrase string
+	// Required for the moderator role; empty means no moderators
+	ModeratorToken string
+	// Created from a claim token (see tokens.go): broadcasters need a
+	// signed token for the room, or BroadcasterToken if one was set
+	tokenBound bool
+
+	// 0 means unlimited
+	MaxListeners int
+	// Cap on estimated egress in bits/s (see egress.go); 0 is unlimited
+	MaxBandwidth int
+
+	// Negotiate stereo Opus (music) rather than mono (talk)
+	Stereo bool
+	// audioPassthrough ("" means the same) or audioTranscode
+	AudioMode string
+
+	// Passed to pion when creating offers and answers for this room
+	VoiceActivityDetection bool
+
+	// Send all ICE candidates in the SDP rather than trickling them (see
+	// trickle.go)
+	NoTrickleICE bool
+
+	// Relay the live audio to this Icecast mount, if set (see icecast.go)
+	IcecastURL string
+
+	// Archive the audio to Options.RecordingDir (see recording.go), as
+	// recordOgg ("" means the same) or recordRTPDump. With
+	// RecordWhenListened, only while someone is listening.
+	Record             bool
+	RecordFormat       string
+	RecordWhenListened bool
+	recording          *recording
+
+	// Region of the instance hosting the room, if configured
+	Region string
+
+	// Listed in /lobby while live
+	Public bool
+
+	// Held for a broadcaster who joins later; removed if none has by
+	// reservedUntil (see reservation.go)
+	Reserved      bool
+	reservedUntil time.Time
+	// Set once any broadcaster has joined
+	claimed bool
+	// Loaded from Options.SeedFile, so never removed as abandoned
+	seeded bool
+	// When the room was first seen with nobody in it (see cleanup.go)
+	unusedSince time.Time
+
+	// Shown to anyone who may see the room's details
+	Title       string
+	Description string
+	// Opaque JSON object from the creator, if any
+	Metadata json.RawMessage
+
+	CreatedAt time.Time
+	// When the current broadcaster's first track arrived; zero while not live
+	StartedAt time.Time
+
+	// What to do once a live room has had no listeners for EmptyTimeout:
+	// "" (nothing), emptyActionNotify or emptyActionEnd
+	EmptyAction  string
+	EmptyTimeout time.Duration
+	// When the listener count last hit zero; zero while anyone is listening
+	EmptySince time.Time
+	emptyTimer *time.Timer
+
+	// Opt-in listener reaping: disconnect after IdleTimeout without any
+	// signaling messages, or after MaxListenDuration regardless (0 disables)
+	IdleTimeout       time.Duration
+	MaxListenDuration time.Duration
+
+	// Options.DuplicateListeners
+	duplicates string
+
+	// Bitrate of broadcaster audio, for egress estimates
+	ingress bitrateMeter
+	// Warn when the broadcaster's bitrate averages under LowBitrateKbps
+	// over LowBitrateWindow (0 disables; see lowbitrate.go)
+	LowBitrateKbps   int
+	LowBitrateWindow time.Duration
+
+	// Recent broadcaster audio for priming new listeners; nil if disabled
+	primer *packetRing
+
+	// Broadcaster audio is written here; every listener has it attached, so
+	// pion fans each packet out to all of them
+	track *webrtc.TrackLocalStaticRTP
+
+	// Shards of track for large rooms (see fanout.go)
+	fanout fanout
+	// len(Listeners), readable without room.mu
+	listenerCount atomic.Int32
+
+	// Keeps sequence numbers continuous across broadcasters
+	rewriter rtpRewriter
+	// Whether a broadcaster track is currently feeding track
+	mainLive bool
+
+	// Recording being played into the room, if any (see replay.go)
+	replay *replay
+
+	// Further broadcaster tracks by name (see tracks.go)
+	extraTracks map[string]*roomTrack
+
+	// Last message on the broadcaster's metadata channel, for late joiners
+	// (see datachannel.go)
+	lastMetadata *webrtc.DataChannelMessage
+
+	// Listener playback reports in the last reportWindow (see report.go)
+	reports roomReports
+
+	// While set, broadcaster packets are dropped instead of forwarded
+	muted atomic.Bool
+	// Same effect as muted, but for a planned break (e.g. ads) rather than
+	// a moderation action, so it's tracked and announced separately
+	paused atomic.Bool
+
+	// Lifecycle events go here; nil for rooms not owned by a Server
+	events *eventBus
+	// Ascending listener counts worth an event, and the index of the next
+	// one not yet reached (see publishListeners). Guarded by mu.
+	milestones    []int
+	nextMilestone int
+	hadListener   bool
+	// Optional per-room lifecycle webhook (see webhook.go)
+	webhook *webhook
+
+	// Latest bandwidth estimate per listener, for REMB towards the broadcaster
+	listenerBitrates map[*webrtc.PeerConnection]int
+
+	// What the room was created with, for /rooms/export
+	options RoomOptions
+	// Who created it, when an Authenticator is set
+	creator *Identity
+}
+
+func newRoom(id string, opts RoomOptions) (*Room, error) {
+	track, err := webrtc.NewTrackLocalStaticRTP(opusCapability(opts.Stereo), "audio", id)
+	if err != nil {
+		return nil, err
+	}
+
+	room := &Room{
+		Name:             id,
+		Listeners:        make(map[*webrtc.PeerConnection]*peer),
+		CreatedAt:        time.Now(),
+		track:            track,
+		options:          opts,
+		listenerBitrates: make(map[*webrtc.PeerConnection]int),
+		extraTracks:      make(map[string]*roomTrack),
+		coHosts:          make(map[*webrtc.PeerConnection]*peer),
+
+		BroadcasterToken:       opts.BroadcasterToken,
+		ListenerPassphrase:     opts.ListenerPassphrase,
+		ModeratorToken:         opts.ModeratorToken,
+		MaxListeners:           opts.MaxListeners,
+		MaxBandwidth:           opts.MaxBandwidth,
+		MaxBroadcasters:        opts.MaxBroadcasters,
+		Stereo:                 opts.Stereo,
+		AudioMode:              opts.AudioMode,
+		VoiceActivityDetection: opts.VoiceActivityDetection,
+		NoTrickleICE:           opts.NoTrickleICE,
+		Title:                  opts.Title,
+		Description:            opts.Description,
+		Metadata:               opts.Metadata,
+		Public:                 opts.Public,
+		Reserved:               opts.Reserved,
+		IcecastURL:             opts.IcecastURL,
+		Record:                 opts.Record,
+		RecordFormat:           opts.RecordFormat,
+		RecordWhenListened:     opts.RecordWhenListened,
+		EmptyAction:            opts.EmptyAction,
+		EmptyTimeout:           opts.EmptyTimeout,
+		IdleTimeout:            opts.IdleTimeout,
+		MaxListenDuration:      opts.MaxListenDuration,
+		LowBitrateKbps:         opts.LowBitrateKbps,
+		LowBitrateWindow:       opts.LowBitrateWindow,
+	}
+	if opts.WebhookURL != "" {
+		room.webhook = &webhook{url: opts.WebhookURL, secret: opts.WebhookSecret}
+	}
+	if opts.MaxBroadcasters > 1 {
+		room.mixer = newMixer(room)
+	}
+	return room, nil
+}
+
+// How a room's audio reaches listeners, chosen with audio_mode:
+// passthrough forwards the broadcaster's RTP as is, so listeners get
+// whatever Opus settings the broadcaster encoded with; transcode re-encodes
+// it to one canonical encoding (see transcode.go).
+const (
+	audioPassthrough = "passthrough"
+	audioTranscode   = "transcode"
+)
+
+// Offer/answer knobs from the room's config, for every negotiation
+func (room *Room) offerAnswerOptions() webrtc.OfferAnswerOptions {
+	return webrtc.OfferAnswerOptions{VoiceActivityDetection: room.VoiceActivityDetection}
+}
+
+func (room *Room) offerOptions() *webrtc.OfferOptions {
+	return &webrtc.OfferOptions{OfferAnswerOptions: room.offerAnswerOptions()}
+}
+
+func (room *Room) answerOptions() *webrtc.AnswerOptions {
+	return &webrtc.AnswerOptions{OfferAnswerOptions: room.offerAnswerOptions()}
+}
+
+// Public view of a room for listings
+type roomInfo struct {
+	Room         string `json:"room"`
+	Listeners    int    `json:"listeners"`
+	Broadcasting bool   `json:"broadcasting"`
+	Muted        bool   `json:"muted"`
+	Paused       bool   `json:"paused"`
+	Region       string `json:"region,omitempty"`
+	CreatedAt    string `json:"created_at"`
+	StartedAt    string `json:"started_at,omitempty"`
+}
+
+func (room *Room) info() roomInfo {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	info := roomInfo{
+		Room:         room.Name,
+		Listeners:    len(room.Listeners),
+		Broadcasting: room.Broadcaster != nil,
+		Muted:        room.muted.Load(),
+		Paused:       room.paused.Load(),
+		Region:       room.Region,
+		CreatedAt:    room.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	if !room.StartedAt.IsZero() {
+		info.StartedAt = room.StartedAt.UTC().Format(time.RFC3339)
+	}
+	return info
+}
+
+// Full view of a single room, for /rooms/{id}
+type roomDetails struct {
+	roomInfo
+	Title        string `json:"title,omitempty"`
+	Description  string `json:"description,omitempty"`
+	MaxListeners int    `json:"max_listeners,omitempty"`
+	MaxBandwidth int    `json:"max_bandwidth,omitempty"`
+	// Estimated bits/s sent to listeners right now
+	Egress int  `json:"egress"`
+	Stereo bool `json:"stereo"`
+	Public bool `json:"public"`
+	// Reserved rooms not yet claimed by a broadcaster
+	ReservedUntil string `json:"reserved_until,omitempty"`
+	// The creator's metadata object
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+func (room *Room) details() roomDetails {
+	info := room.info()
+	details := roomDetails{
+		roomInfo:     info,
+		Title:        room.Title,
+		Description:  room.Description,
+		Metadata:     room.Metadata,
+		MaxListeners: room.MaxListeners,
+		MaxBandwidth: room.MaxBandwidth,
+		Egress:       room.egress(info.Listeners),
+		Stereo:       room.Stereo,
+		Public:       room.Public,
+	}
+	room.mu.RLock()
+	if !room.reservedUntil.IsZero() {
+		details.ReservedUntil = room.reservedUntil.UTC().Format(time.RFC3339)
+	}
+	room.mu.RUnlock()
+	return details
+}
+
+// Broadcaster status as sent to listeners
+const (
+	statusWaiting = "waiting_for_broadcaster"
+	statusReady   = "broadcaster_ready"
+)
+
+// What a joining listener should be told about the broadcaster: "" with
+// none, statusWaiting while it's connected but not sending, else statusReady
+func (room *Room) broadcasterStatus() string {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	switch {
+	case room.Broadcaster == nil:
+		return ""
+	case room.mainLive:
+		return statusReady
+	}
+	return statusWaiting
+}
+
+// Bring a newly arrived listener up to date: broadcaster status, room
+// metadata, and the same messages listeners already present got for
+// whatever is in effect now (muted, paused, a replay), so a late joiner
+// isn't left wondering why it hears nothing
+func (room *Room) greet(ws *signalConn) {
+	if status := room.broadcasterStatus(); status != "" {
+		ws.WriteJSON(map[string]string{"type": status})
+	}
+	if room.Metadata != nil {
+		ws.WriteJSON(map[string]any{"type": "room_metadata", "metadata": room.Metadata})
+	}
+	if room.muted.Load() {
+		ws.WriteJSON(map[string]string{"type": "muted"})
+	}
+	if room.paused.Load() {
+		ws.WriteJSON(map[string]string{"type": "paused"})
+	}
+	room.mu.RLock()
+	rp := room.replay
+	room.mu.RUnlock()
+	if rp != nil {
+		ws.WriteJSON(map[string]any{"type": "replay_started", "file": rp.file, "loop": rp.loop})
+	}
+}
+
+// The broadcaster, co-host or listener with the given ID, or nil
+func (room *Room) peerByID(id string) *peer {
+	for _, p := range room.peers() {
+		if p.id == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// The broadcaster, any co-hosts and every listener, in join order
+func (room *Room) peers() []*peer {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	peers := make([]*peer, 0, len(room.Listeners)+len(room.coHosts)+1)
+	if room.broadcasterPeer != nil {
+		peers = append(peers, room.broadcasterPeer)
+	}
+	for _, p := range room.coHosts {
+		peers = append(peers, p)
+	}
+	for _, p := range room.Listeners {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].joinedAt.Before(peers[j].joinedAt) })
+	return peers
+}
+
+// Snapshot for {"type":"room_state"}, the broadcaster's dashboard view
+func (room *Room) state() map[string]any {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	peers := make([]*peer, 0, len(room.Listeners))
+	for _, p := range room.Listeners {
+		peers = append(peers, p)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].joinedAt.Before(peers[j].joinedAt) })
+
+	listeners := make([]map[string]any, 0, len(peers))
+	for _, p := range peers {
+		l := map[string]any{
+			"id":        p.id,
+			"role":      p.role,
+			"joined_at": p.joinedAt.UTC().Format(time.RFC3339),
+		}
+		if name := p.displayName(); name != "" {
+			l["name"] = name
+		}
+		// Omitted until the listener's first reception report
+		if q := p.quality.Load(); q > 0 {
+			l["quality"] = q
+		}
+		listeners = append(listeners, l)
+	}
+
+	state := map[string]any{
+		"type":         "room_state",
+		"room":         room.Name,
+		"count":        len(room.Listeners),
+		"listeners":    listeners,
+		"broadcasting": room.Broadcaster != nil,
+		"muted":        room.muted.Load(),
+		"paused":       room.paused.Load(),
+		"recording":    room.recording != nil,
+		"egress":       room.egress(len(room.Listeners)),
+	}
+	if !room.StartedAt.IsZero() {
+		state["uptime"] = time.Since(room.StartedAt).Seconds()
+	}
+	if room.replay != nil {
+		state["replay"] = room.replay.file
+	}
+	if reports := room.reportCounts(); len(reports) > 0 {
+		state["reports"] = reports
+	}
+	return state
+}
+
+// Returns codeRoomFull, codeBandwidthExceeded or codeDuplicateListener if
+// the room can't take another listener, else ""
+func (room *Room) addListener(p *peer) string {
+	code, replaced := room.admitListener(p)
+	if replaced != nil {
+		replaced.sendReplaced()
+	}
+	return code
+}
+
+// addListener under room.mu, also returning any listener p replaced
+func (room *Room) admitListener(p *peer) (string, *peer) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	code, replaced := room.claimIdentity(p)
+	if code != "" {
+		return code, nil
+	}
+	if code := room.capacityCode(); code != "" {
+		return code, replaced
+	}
+	wasFull := room.isFull()
+	room.attachExtras(p)
+	room.Listeners[p.pc] = p
+	room.listenerCount.Store(int32(len(room.Listeners)))
+	if room.isFull() != wasFull {
+		room.notifyCapacity()
+	}
+	room.updateEmpty()
+	room.publishListeners(p, true)
+	return "", replaced
+}
+
+func (room *Room) removeListener(pc *webrtc.PeerConnection) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+	room.dropListener(pc)
+}
+
+// Caller must hold room.mu
+func (room *Room) dropListener(pc *webrtc.PeerConnection) {
+	p := room.Listeners[pc]
+	if p == nil {
+		return
+	}
+	wasFull := room.isFull()
+	delete(room.Listeners, pc)
+	room.listenerCount.Store(int32(len(room.Listeners)))
+	delete(room.listenerBitrates, pc)
+	if room.isFull() != wasFull {
+		room.notifyCapacity()
+	}
+	room.updateEmpty()
+	room.publishListeners(p, false)
+}
+
+// The error code turning away one more listener, or "". Caller must hold
+// room.mu.
+func (room *Room) capacityCode() string {
+	if room.isFull() {
+		return codeRoomFull
+	}
+	if room.overBandwidth() {
+		return codeBandwidthExceeded
+	}
+	return ""
+}
+
+// The client-facing message for an addListener error code
+func joinMessage(code string) string {
+	switch code {
+	case codeBandwidthExceeded:
+		return "Room has reached its bandwidth limit"
+	case codeDuplicateListener:
+		return "Already listening to this room on another connection"
+	}
+	return "Room is full"
+}
+
+// Caller must hold room.mu
+func (room *Room) isFull() bool {
+	return room.MaxListeners > 0 && len(room.Listeners) >= room.MaxListeners
+}
+
+// Tell the broadcaster the room flipped between "has capacity" and "full".
+// Caller must hold room.mu.
+func (room *Room) notifyCapacity() {
+	if room.broadcasterWS == nil {
+		return
+	}
+	room.broadcasterWS.WriteJSON(map[string]any{
+		"type":  "capacity",
+		"full":  room.isFull(),
+		"count": len(room.Listeners),
+		"max":   room.MaxListeners,
+	})
+}
+
+const (
+	emptyActionNotify = "notify"
+	emptyActionEnd    = "end"
+)
+
+// Track the empty-since time and arm or cancel the no-listeners timer.
+// Caller must hold room.mu.
+func (room *Room) updateEmpty() {
+	if len(room.Listeners) > 0 {
+		room.EmptySince = time.Time{}
+		room.stopEmptyTimer()
+		return
+	}
+	if room.EmptySince.IsZero() {
+		room.EmptySince = time.Now()
+	}
+	if room.EmptyAction == "" || room.broadcasterWS == nil || room.emptyTimer != nil {
+		return
+	}
+	room.emptyTimer = time.AfterFunc(room.EmptyTimeout-time.Since(room.EmptySince), room.emptyTimeout)
+}
+
+// Caller must hold room.mu
+func (room *Room) stopEmptyTimer() {
+	if room.emptyTimer != nil {
+		room.emptyTimer.Stop()
+		room.emptyTimer = nil
+	}
+}
+
+func (room *Room) emptyTimeout() {
+	room.mu.Lock()
+	room.emptyTimer = nil
+	ws := room.broadcasterWS
+	if len(room.Listeners) > 0 || ws == nil {
+		room.mu.Unlock()
+		return
+	}
+	end := room.EmptyAction == emptyActionEnd
+	room.mu.Unlock()
+
+	log.Printf("Room %s has had no listeners for %s (end=%v)", room.Name, room.EmptyTimeout, end)
+	ws.WriteJSON(map[string]any{"type": "no_listeners", "ended": end})
+	if end {
+		// The broadcaster's handler sees the read fail and tears down
+		ws.CloseWith(websocket.CloseNormalClosure, "Room ended: no listeners")
+	}
+}
+
+// Send a message to the broadcaster and every listener
+func (room *Room) broadcast(msg any) {
+	room.mu.RLock()
+	defer room.mu.RUnlock()
+
+	if room.broadcasterWS != nil {
+		room.broadcasterWS.WriteJSON(msg)
+	}
+	for _, p := range room.Listeners {
+		p.ws.WriteJSON(msg)
+	}
+}
+
+// Returns false if the room was already in that state
+func (room *Room) setMuted(muted bool) bool {
+	if room.muted.Swap(muted) == muted {
+		return false
+	}
+	if muted && room.primer != nil {
+		room.primer.reset()
+	}
+	event := "unmuted"
+	if muted {
+		event = "muted"
+	}
+	room.broadcast(map[string]string{"type": event})
+	return true
+}
+
+// Pause or resume forwarding; returns false if the room was already in
+// that state
+func (room *Room) setPaused(paused bool) bool {
+	if room.paused.Swap(paused) == paused {
+		return false
+	}
+	// Nothing from before the break should be replayed to joiners after it
+	if paused && room.primer != nil {
+		room.primer.reset()
+	}
+	event := "resumed"
+	if paused {
+		event = "paused"
+	}
+	room.broadcast(map[string]string{"type": event})
+	return true
+}
+
+// Whether broadcaster audio is being held back, muted or paused
+func (room *Room) holding() bool {
+	return room.muted.Load() || room.paused.Load()
+}
+
+// Extra consumers of the forwarded audio (Icecast relay, recording)
+type packetSink interface {
+	write(pkt *rtp.Packet)
+}
+
+// Channel count for Ogg muxing: Opus always negotiates 2, but mono rooms
+// carry mono audio
+func (room *Room) channels() uint16 {
+	if room.Stereo {
+		return 2
+	}
+	return 1
+}
+
+// Copies the broadcaster's packets into the room track and any sinks
+func (room *Room) forward(remoteTrack *webrtc.TrackRemote, sinks ...packetSink) {
+	first := true
+	watch := room.newBitrateWatch()
+	if watch != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go room.watchBitrate(watch, done)
+	}
+	fw := room.newFanoutWriter()
+	defer fw.close()
+
+	var tc *transcoder
+	relay := func(pkt *rtp.Packet) { room.relay(pkt, fw, sinks) }
+	if room.AudioMode == audioTranscode {
+		var err error
+		if tc, err = newTranscoder(int(room.channels())); err != nil {
+			log.Printf("Room %s passing audio through: %v", room.Name, err)
+		} else {
+			defer tc.close()
+		}
+	}
+
+	var in rtpReader
+	for {
+		pkt, err := in.read(remoteTrack)
+		if err != nil {
+			return
+		}
+		if watch != nil {
+			room.checkBitrate(watch, pkt.MarshalSize())
+		}
+		if first {
+			room.rewriter.rebase(pkt, remoteTrack.Codec().ClockRate)
+			first = false
+		}
+		if tc == nil {
+			room.relay(pkt, fw, sinks)
+		} else if err := tc.process(pkt, relay); err != nil {
+			log.Printf("Transcoding in room %s: %v", room.Name, err)
+		}
+	}
+}
+
+// Send one main-track packet on to the listeners, primer and sinks. The
+// packet is reused once this returns (see rtpbuf.go).
+func (room *Room) relay(pkt *rtp.Packet, fw *fanoutWriter, sinks []packetSink) {
+	// Keep draining while held so the broadcaster's buffers don't back up
+	if room.holding() {
+		room.rewriter.skip()
+		return
+	}
+	room.rewriter.rewrite(pkt)
+	room.ingress.add(pkt.MarshalSize())
+	if room.primer != nil {
+		room.primer.write(pkt)
+	}
+	fw.write(pkt)
+	for _, sink := range sinks {
+		sink.write(pkt)
+	}
+}
+
+// An unset secret accepts anything
+func secretMatches(secret, given string) bool {
+	if secret == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(given)) == 1
+}
+
+func randomHex(n int) string {
+	bytes := make([]byte, n)
+	rand.Read(bytes)
+	return hex.EncodeToString(bytes)
+}
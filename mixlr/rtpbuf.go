@@ -0,0 +1,60 @@
+package mixlr
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+)
+
+// The forwarding path runs once per packet per room, so the buffers it
+// needs are kept and reused rather than allocated each time. Anything
+// that holds on to a packet past the call it was handed in must copy it.
+
+// Largest packet read from a broadcaster: pion's default receive MTU
+const receiveMTU = 1500
+
+// Where packets are read from; a *webrtc.TrackRemote
+type rtpSource interface {
+	Read(b []byte) (int, interceptor.Attributes, error)
+}
+
+// Reads packets into one buffer and rtp.Packet, which TrackRemote.ReadRTP
+// would allocate afresh for every packet. Each packet is only valid until
+// the next read.
+type rtpReader struct {
+	buf []byte
+	pkt rtp.Packet
+}
+
+func (r *rtpReader) read(src rtpSource) (*rtp.Packet, error) {
+	if r.buf == nil {
+		r.buf = make([]byte, receiveMTU)
+	}
+	n, _, err := src.Read(r.buf)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.pkt.Unmarshal(r.buf[:n]); err != nil {
+		return nil, err
+	}
+	return &r.pkt, nil
+}
+
+// A copy of a packet in storage of its own, reused by the next copy.
+// Round-tripping through the wire format copies header extensions too,
+// which rtp.Packet only exposes by allocating.
+type packetCopy struct {
+	buf []byte
+	pkt rtp.Packet
+}
+
+func (c *packetCopy) set(src *rtp.Packet) error {
+	n := src.MarshalSize()
+	if cap(c.buf) < n {
+		c.buf = make([]byte, n, max(n, receiveMTU))
+	}
+	c.buf = c.buf[:n]
+	if _, err := src.MarshalTo(c.buf); err != nil {
+		return err
+	}
+	return c.pkt.Unmarshal(c.buf)
+}
@@ -0,0 +1,65 @@
+package mixlr
+
+import (
+	"bufio"
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// Writes packets in rtptools' rtpdump format, which rtpplay can replay and
+// Wireshark opens directly. Each packet is stored exactly as forwarded, so
+// a recording can be fed back through the server to reproduce a problem.
+type rtpDumpWriter struct {
+	f     *os.File
+	buf   *bufio.Writer
+	start time.Time
+}
+
+func newRTPDumpWriter(path string) (*rtpDumpWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := &rtpDumpWriter{f: f, buf: bufio.NewWriter(f), start: time.Now()}
+
+	// Text preamble naming the (here meaningless) source address, then
+	// the binary file header: start time, source address and port
+	w.buf.WriteString("#!rtpplay1.0 0.0.0.0/0\n")
+	var hdr [16]byte
+	binary.BigEndian.PutUint32(hdr[0:], uint32(w.start.Unix()))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(w.start.Nanosecond()/1000))
+	if _, err := w.buf.Write(hdr[:]); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *rtpDumpWriter) WriteRTP(pkt *rtp.Packet) error {
+	data, err := pkt.Marshal()
+	if err != nil {
+		return err
+	}
+	// Per packet: total length including this 8-byte header, RTP length,
+	// then milliseconds since the start of the file
+	var hdr [8]byte
+	binary.BigEndian.PutUint16(hdr[0:], uint16(len(data)+len(hdr)))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(data)))
+	binary.BigEndian.PutUint32(hdr[4:], uint32(time.Since(w.start).Milliseconds()))
+	if _, err := w.buf.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err = w.buf.Write(data)
+	return err
+}
+
+func (w *rtpDumpWriter) Close() error {
+	if err := w.buf.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
@@ -0,0 +1,93 @@
+package mixlr
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Capping a broadcaster's bitrate (Options.MaxBroadcastBitrate) works by
+// editing SDP bandwidth lines as text:
+//
+//   - b=AS (kbps) and b=TIAS (bps) lines in the broadcaster's offer that
+//     exceed the cap are lowered before the offer is applied
+//   - our answer gets b=AS and b=TIAS at the cap in each audio section,
+//     which is what tells the browser to send no more than that
+//
+// Limitations: this is a request, not enforcement. Browsers honour it (Chrome
+// reads b=AS, Firefox b=TIAS), but a modified client can ignore it, and the
+// server doesn't police the rate of the RTP it actually receives. Only
+// bandwidth lines are touched; anything else in the SDP passes through
+// byte for byte.
+
+// Opus can't usefully go below this, so neither can the cap
+const minBroadcasterBitrate = 6000
+
+// Lower any b=AS or b=TIAS line above maxBps. Reports whether anything
+// changed.
+func capBandwidth(sdp string, maxBps int) (string, bool) {
+	lines := strings.Split(sdp, "\r\n")
+	changed := false
+	for i, line := range lines {
+		if capped, ok := capBandwidthLine(line, maxBps); ok {
+			lines[i] = capped
+			changed = true
+		}
+	}
+	return strings.Join(lines, "\r\n"), changed
+}
+
+func capBandwidthLine(line string, maxBps int) (string, bool) {
+	if v, ok := strings.CutPrefix(line, "b=AS:"); ok {
+		if kbps, err := strconv.Atoi(v); err == nil && kbps*1000 > maxBps {
+			return "b=AS:" + strconv.Itoa(maxBps/1000), true
+		}
+	}
+	if v, ok := strings.CutPrefix(line, "b=TIAS:"); ok {
+		if bps, err := strconv.Atoi(v); err == nil && bps > maxBps {
+			return "b=TIAS:" + strconv.Itoa(maxBps), true
+		}
+	}
+	return line, false
+}
+
+// Set b=AS and b=TIAS to maxBps in every active audio section, replacing
+// any bandwidth lines already there. They go after the section's c= line,
+// or straight after the m= line without one, as RFC 8866 orders them.
+func addBandwidth(sdp string, maxBps int) string {
+	lines := strings.Split(sdp, "\r\n")
+	out := make([]string, 0, len(lines)+4)
+	bandwidth := []string{
+		"b=AS:" + strconv.Itoa(maxBps/1000),
+		"b=TIAS:" + strconv.Itoa(maxBps),
+	}
+
+	inAudio := false
+	pending := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			if pending {
+				// Audio section with nothing after its m= line
+				out = append(out, bandwidth...)
+			}
+			// A rejected section has port 0
+			inAudio = strings.HasPrefix(line, "m=audio ") && !strings.HasPrefix(line, "m=audio 0 ")
+			pending = inAudio
+			out = append(out, line)
+			continue
+		}
+		if inAudio {
+			if strings.HasPrefix(line, "b=") {
+				continue
+			}
+			if pending && !strings.HasPrefix(line, "i=") && !strings.HasPrefix(line, "c=") {
+				out = append(out, bandwidth...)
+				pending = false
+			}
+		}
+		out = append(out, line)
+	}
+	if pending {
+		out = append(out, bandwidth...)
+	}
+	return strings.Join(out, "\r\n")
+}
@@ -0,0 +1,1141 @@
+// Package mixlr is the Mini-Mixlr audio SFU: rooms with a single WebRTC
+// broadcaster whose audio is forwarded to any number of listeners, with
+// signaling over WebSocket.
+package mixlr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/webrtc/v4"
+)
+
+type Options struct {
+	// Proxies whose forwarding headers are believed when resolving client IPs.
+	// Empty means headers are never trusted.
+	TrustedProxies []netip.Prefix
+
+	// Estimate listener bandwidth and report it to the broadcaster as REMB
+	BandwidthEstimation bool
+
+	// Run ICE-lite: offer only host candidates and let clients drive
+	// connectivity checks. Saves gathering time, but the host addresses
+	// must be reachable by clients, i.e. the server needs a public IP.
+	ICELite bool
+
+	// Use no STUN or TURN servers, so only host candidates are gathered.
+	// For offline development and tests over loopback.
+	NoSTUN bool
+
+	// Gather every ICE candidate before sending an offer or answer, for
+	// all rooms, instead of trickling them (see trickle.go)
+	NoTrickleICE bool
+
+	// Offers allowed per connection within RenegotiationWindow (0 disables)
+	RenegotiationLimit  int
+	RenegotiationWindow time.Duration
+
+	// TURN servers whose time-limited credentials are minted per connection
+	// from TURNSecret, valid for TURNTTL (see turn.go). Unset means STUN only.
+	// turn: and turns: URLs are accepted, e.g. "turns:turn.example.com:443"
+	// for networks that only let TLS through. SetTURNSecret rotates the
+	// secret without a restart.
+	TURNURLs   []string
+	TURNSecret string
+	TURNTTL    time.Duration
+
+	// Cap on each room's estimated egress in bits/s (0 disables). Rooms
+	// may set a lower max_bandwidth of their own, not a higher one.
+	MaxRoomBandwidth int
+
+	// Concurrent listener connections allowed from one client IP (0 disables)
+	MaxListenersPerIP int
+
+	// Signaling messages allowed per second per connection (0 disables),
+	// with bursts of up to MessageBurst (0 means one second's worth).
+	// Exceeding it closes the connection.
+	MessageRate  int
+	MessageBurst int
+
+	// Grants access to private room details (and other admin endpoints)
+	// via "Authorization: Bearer <token>". Empty disables admin access.
+	AdminToken string
+	// Live log output for admins at /admin/logs (see logstream.go). Nil
+	// disables the endpoint.
+	Logs *LogHub
+
+	// Rooms created with record=true are archived here, as Ogg/Opus or an
+	// rtpdump file depending on the room's record_format. Empty disables
+	// recording. A recording stays open for RecordingGrace after the
+	// broadcaster leaves, so a quick reconnect continues the same file.
+	RecordingDir   string
+	RecordingGrace time.Duration
+
+	// Where requests for the bare domain are redirected, e.g. the frontend.
+	// Empty serves a small JSON status instead.
+	RootRedirect string
+
+	// Where this instance runs, reported on created and listed rooms so a
+	// front door can route listeners to the broadcaster's instance.
+	// RegionURL, if set, is this instance's own base URL (no trailing
+	// slash) and yields a region-specific room link.
+	Region    string
+	RegionURL string
+
+	// DTLS certificate file shared by all peer connections, created if
+	// missing; empty generates one per process. DTLSRole ("client",
+	// "server" or "" for pion's default) is the role taken when answering.
+	DTLSCertFile string
+	DTLSRole     string
+
+	// Payload type Opus is registered under, for gateways that expect a
+	// fixed one. 0 keeps pion's default (111); otherwise 96-127.
+	OpusPayloadType int
+
+	// Retries when creating a peer connection fails, starting at
+	// PCCreateRetryDelay and doubling
+	PCCreateRetries    int
+	PCCreateRetryDelay time.Duration
+
+	// Push listeners a 1–5 connection quality score computed from their
+	// RTCP reports (see quality.go). Nil disables.
+	Quality *QualityThresholds
+
+	// How long a peer's connection is kept after its signaling socket drops,
+	// for the client to reattach with its session token (0 disables)
+	ReattachWindow time.Duration
+
+	// How long an Idempotency-Key on /create keeps returning the room it
+	// created (0 ignores the header)
+	IdempotencyTTL time.Duration
+
+	// Recent main-track packets sent to a listener as soon as it connects,
+	// so it doesn't wait for the next one to hear anything (0 disables).
+	// A few hundred milliseconds' worth, e.g. 10 at 20ms, is plenty.
+	PrimePackets int
+
+	// Packets kept per outgoing stream while a peer is still connecting,
+	// sent once it's up (0 drops them; see gate.go). Oldest go first when
+	// full.
+	PreconnectBuffer int
+
+	// Checks /create and /join requests (see auth.go). Nil leaves them open.
+	Authenticator Authenticator
+	// Listener counts that fire a listener_milestone event and webhook the
+	// first time a room reaches them. Nil uses defaultListenerMilestones;
+	// empty disables them.
+	ListenerMilestones []int
+	// What happens when an authenticated identity joins a room it's already
+	// listening to: "" allows it, DuplicateListenerReject turns the new
+	// connection away, DuplicateListenerReplace disconnects the old one
+	// (see duplicates.go)
+	DuplicateListeners string
+
+	// Hosts anyone may point a room's icecast_url or webhook_url at; any
+	// other host needs the admin token (see outbound.go)
+	OutboundHosts []string
+
+	// Rooms one authenticated identity may have at once (0 disables; see
+	// quota.go)
+	MaxRoomsPerUser int
+
+	// How long a room may go without a broadcaster, listeners or a replay
+	// before it's removed, freeing its ID and its creator's quota (0 keeps
+	// rooms forever; see cleanup.go)
+	RoomIdleTimeout time.Duration
+
+	// Most rooms one /lobby page lists, and the most ?limit= may ask for
+	// (default 50)
+	MaxLobbyRooms int
+	// Bot check for listener joins (see captcha.go). Nil disables.
+	ListenerVerifier ListenerVerifier
+
+	// How long a connected broadcaster may go without sending a track
+	// before it's sent {"type":"no_track"} (0 disables)
+	FirstTrackTimeout time.Duration
+
+	// SDP negotiations (offers made, answers created or applied) allowed
+	// to run at once; the rest wait their turn (0 disables)
+	MaxNegotiations int
+
+	// Most a broadcaster is asked to send, in bits/s, via the SDP bandwidth
+	// lines (see sdpbandwidth.go). Advisory only. 0 disables.
+	MaxBroadcastBitrate int
+
+	// Shards a room's main track is split into so large rooms can write to
+	// listeners in parallel, and the listener count at which they start to
+	// (default 500). 0 or 1 keeps a single track. See fanout.go.
+	FanoutWorkers   int
+	FanoutThreshold int
+
+	// Load limits checked before upgrading a join; over any of them the
+	// client gets a 503 instead (see load.go). MaxConnections counts live
+	// signaling sockets, MaxGoroutines the process's goroutines (0 disables
+	// either), and Overloaded is any custom signal, e.g. CPU pressure.
+	MaxConnections int
+	MaxGoroutines  int
+	Overloaded     func() bool
+
+	// Close peers whose connection isn't up within this long (0 disables)
+	HandshakeTimeout time.Duration
+	// Longest to wait on a PeerConnection's Close during teardown before
+	// abandoning it (0 waits indefinitely)
+	PeerCloseTimeout time.Duration
+
+	// Minimum spacing between forwarded packets per stream (0 disables).
+	// Smooths bursts at the cost of added latency; see pacer.go.
+	PacingGap time.Duration
+
+	// How long a room created with reserved=true waits for its broadcaster
+	// before it's removed (0 keeps reserved rooms indefinitely)
+	ReservationWindow time.Duration
+
+	// MIME types (e.g. "audio/opus") in the order our SDP should list them.
+	// Each must be a codec the server registers; unlisted ones follow.
+	// Empty leaves pion's order.
+	CodecPreferences []string
+
+	// Key for broadcaster tokens minted by POST /tokens (see tokens.go).
+	// Empty disables them.
+	TokenSecret string
+
+	// Rooms to recreate at startup, in the format GET /rooms/export writes.
+	// Empty starts with no rooms.
+	SeedFile string
+}
+
+type Server struct {
+	opts     Options
+	upgrader websocket.Upgrader
+
+	// Shared by every peer connection so codecs and interceptors are set up
+	// once; stereo rooms use their own
+	api       *webrtc.API
+	stereoAPI *webrtc.API
+	// Options.CodecPreferences for each API; nil if unset
+	codecPrefs       []webrtc.RTPCodecParameters
+	stereoCodecPrefs []webrtc.RTPCodecParameters
+	// DTLS certificate shared by every peer connection, replaced before it
+	// expires (see dtls.go)
+	certificate atomic.Pointer[webrtc.Certificate]
+
+	// The cc and gate factories hand out per-connection state through
+	// callbacks fired inside NewPeerConnection, so creation is serialized
+	// to pair them up
+	pcCreateMu   sync.Mutex
+	newEstimator cc.BandwidthEstimator
+	newGate      *sendGate
+
+	rooms   map[string]*Room
+	roomsMu sync.RWMutex
+	// Options.ListenerMilestones sorted, or the defaults
+	milestones []int
+	// Current TURN secret; starts as Options.TURNSecret (see SetTURNSecret)
+	turnSecret atomic.Pointer[string]
+	// Live rooms per creator, for MaxRoomsPerUser (see quota.go)
+	roomsByOwner map[string]int
+
+	// Slots for concurrent negotiations; nil if unlimited (see negotiate)
+	negotiations chan struct{}
+
+	// Rooms by Idempotency-Key (see idempotency.go)
+	idempotency idempotencyCache
+
+	// Room lifecycle events for /events
+	events eventBus
+
+	metrics metrics
+
+	// Concurrent listener connections per client IP
+	listenersPerIP map[string]int
+	ipMu           sync.Mutex
+
+	// Peers whose signaling can be reattached, by session token
+	sessions   map[string]*session
+	sessionsMu sync.Mutex
+
+	// Live signaling sockets, closed on shutdown
+	conns    map[*signalConn]struct{}
+	connsMu  sync.Mutex
+	closing  bool
+	handlers sync.WaitGroup
+	// Closed on shutdown to end long-lived HTTP streams (/events)
+	quit chan struct{}
+}
+
+func NewServer(opts Options) (*Server, error) {
+	s := &Server{
+		opts: opts,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:  func(r *http.Request) bool { return true }, // Warning: Remove in production
+			Subprotocols: subprotocols,
+		},
+		rooms:          make(map[string]*Room),
+		roomsByOwner:   make(map[string]int),
+		conns:          make(map[*signalConn]struct{}),
+		listenersPerIP: make(map[string]int),
+		sessions:       make(map[string]*session),
+		quit:           make(chan struct{}),
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.MaxNegotiations > 0 {
+		s.negotiations = make(chan struct{}, opts.MaxNegotiations)
+	}
+	s.turnSecret.Store(&opts.TURNSecret)
+	s.milestones = defaultListenerMilestones
+	if opts.ListenerMilestones != nil {
+		s.milestones = slices.Clone(opts.ListenerMilestones)
+		slices.Sort(s.milestones)
+	}
+
+	cert, err := loadCertificate(opts.DTLSCertFile)
+	if err != nil {
+		return nil, err
+	}
+	s.certificate.Store(cert)
+	if s.api, err = s.newAPI(false); err != nil {
+		return nil, err
+	}
+	if s.stereoAPI, err = s.newAPI(true); err != nil {
+		return nil, err
+	}
+	if s.codecPrefs, err = s.codecPreferences(false); err != nil {
+		return nil, err
+	}
+	if s.stereoCodecPrefs, err = s.codecPreferences(true); err != nil {
+		return nil, err
+	}
+	if opts.SeedFile != "" {
+		if err := s.seedRooms(opts.SeedFile); err != nil {
+			return nil, err
+		}
+	}
+	go s.renewCertificate()
+	if opts.RoomIdleTimeout > 0 {
+		go s.sweepRooms()
+	}
+	return s, nil
+}
+
+// Register the server's routes on a caller-supplied mux
+func (s *Server) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/{$}", s.root)
+	mux.HandleFunc("/create", s.createRoom)
+	mux.HandleFunc("/join/", s.joinRoom)
+	mux.HandleFunc("/rooms", s.listRooms)
+	mux.HandleFunc("GET /rooms/{id}", s.getRoom)
+	mux.HandleFunc("POST /rooms/validate", s.validateRoom)
+	mux.HandleFunc("GET /rooms/export", s.exportRooms)
+	mux.HandleFunc("POST /tokens", s.issueToken)
+	mux.HandleFunc("GET /rooms/{id}/sessions", s.listSessions)
+	mux.HandleFunc("DELETE /rooms/{id}/sessions/{sid}", s.revokeSession)
+	mux.HandleFunc("GET /rooms/{id}/sessions/{sid}/stats", s.sessionStats)
+	mux.HandleFunc("POST /rooms/{id}/replay", s.startReplay)
+	mux.HandleFunc("DELETE /rooms/{id}/replay", s.stopReplay)
+	mux.HandleFunc("GET /events", s.streamEvents)
+	mux.HandleFunc("GET /admin/logs", s.streamLogs)
+	mux.HandleFunc("GET /lobby", s.lobby)
+	mux.HandleFunc("GET /metrics", s.serveMetrics)
+	mux.HandleFunc("GET /capacity", s.capacity)
+}
+
+// Standalone handler with all routes; wrap in http.StripPrefix to mount
+// under a sub-path
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	s.Register(mux)
+	return mux
+}
+
+// Close every signaling socket (which tears down its peer connection) and
+// wait for the handlers to finish. New joins are refused from here on.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsMu.Lock()
+	if !s.closing {
+		close(s.quit)
+	}
+	s.closing = true
+	for ws := range s.conns {
+		ws.CloseWith(websocket.CloseGoingAway, "Server is shutting down")
+	}
+	s.connsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Don't leave recordings waiting out their grace period
+	s.roomsMu.RLock()
+	defer s.roomsMu.RUnlock()
+	for _, room := range s.rooms {
+		room.stopReplay()
+		room.stopRecording()
+	}
+	return nil
+}
+
+var errShuttingDown = errors.New("server shutting down")
+
+// How long a live room may sit without listeners before its empty_action runs
+const defaultEmptyTimeout = 5 * time.Minute
+
+func (s *Server) trackConn(ws *signalConn) error {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.closing {
+		return errShuttingDown
+	}
+	s.conns[ws] = struct{}{}
+	s.handlers.Add(1)
+	return nil
+}
+
+func (s *Server) untrackConn(ws *signalConn) {
+	s.connsMu.Lock()
+	delete(s.conns, ws)
+	s.connsMu.Unlock()
+	s.handlers.Done()
+}
+
+// Count a listener connection against its IP; false if over the limit
+func (s *Server) acquireIP(ip string) bool {
+	s.ipMu.Lock()
+	defer s.ipMu.Unlock()
+
+	if s.opts.MaxListenersPerIP > 0 && s.listenersPerIP[ip] >= s.opts.MaxListenersPerIP {
+		return false
+	}
+	s.listenersPerIP[ip]++
+	return true
+}
+
+func (s *Server) releaseIP(ip string) {
+	s.ipMu.Lock()
+	defer s.ipMu.Unlock()
+
+	if s.listenersPerIP[ip]--; s.listenersPerIP[ip] <= 0 {
+		delete(s.listenersPerIP, ip)
+	}
+}
+
+func (s *Server) createRoom(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	// Optional: a retry with the same key gets the room made the first time
+	var created string
+	if k := r.Header.Get("Idempotency-Key"); k != "" && s.opts.IdempotencyTTL > 0 {
+		if len(k) > maxIdempotencyKeyLen {
+			http.Error(w, "Idempotency-Key too long", http.StatusBadRequest)
+			return
+		}
+		key := identity.String() + "\x00" + k
+		roomID, replayed, err := s.idempotency.begin(r.Context(), key)
+		if err != nil {
+			// The client gave up waiting for its earlier attempt
+			return
+		}
+		if replayed {
+			log.Printf("Room %s returned again for a repeated create from %s", roomID, s.clientIP(r))
+			w.Header().Set("Idempotent-Replayed", "true")
+			s.writeCreated(w, roomID)
+			return
+		}
+		defer func() { s.idempotency.finish(key, created, time.Now(), s.opts.IdempotencyTTL) }()
+	}
+
+	opts, errs := s.roomOptions(w, r)
+	if errs != nil {
+		writeOptionErrors(w, errs)
+		return
+	}
+
+	// A signed token (see tokens.go) picks the room ID
+	roomID := randomHex(6)
+	claim := r.URL.Query().Get("claim")
+	if claim != "" {
+		claims, err := s.verifyToken(claim, time.Now())
+		if err != nil {
+			log.Printf("Rejected claim token from %s: %v", s.clientIP(r), err)
+			http.Error(w, "Invalid claim token", http.StatusForbidden)
+			return
+		}
+		roomID = claims.Room
+	}
+	room, err := newRoom(roomID, opts)
+	if err != nil {
+		http.Error(w, "Failed to create room", http.StatusInternalServerError)
+		return
+	}
+	room.creator = identity
+	room.tokenBound = claim != ""
+	switch err := s.addRoom(room); err {
+	case errRoomExists:
+		http.Error(w, "Room already exists", http.StatusConflict)
+		return
+	case errRoomQuota:
+		log.Printf("Room quota reached for %s", identity)
+		writeQuotaExceeded(w, s.opts.MaxRoomsPerUser)
+		return
+	}
+	log.Printf("Room %s created by %s (%s)", roomID, s.clientIP(r), identity)
+	room.publish(roomEvent{Type: eventRoomCreated})
+	created = roomID
+	s.writeCreated(w, roomID)
+}
+
+// The /create response for a room
+func (s *Server) writeCreated(w http.ResponseWriter, roomID string) {
+	resp := map[string]string{
+		"room": roomID,
+		"url":  roomURL(roomID),
+	}
+	if s.opts.Region != "" {
+		resp["region"] = s.opts.Region
+	}
+	if s.opts.RegionURL != "" {
+		resp["region_url"] = s.opts.RegionURL + "/r/" + roomID
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+var (
+	errRoomExists = errors.New("room already exists")
+	errRoomQuota  = errors.New("room quota exceeded")
+)
+
+// Register a new room with the server. Fails with errRoomExists if its ID
+// is taken, or errRoomQuota if its creator has too many rooms.
+func (s *Server) addRoom(room *Room) error {
+	room.Region = s.opts.Region
+	room.events = &s.events
+	room.milestones = s.milestones
+	room.duplicates = s.opts.DuplicateListeners
+	if s.opts.PrimePackets > 0 {
+		room.primer = newPacketRing(s.opts.PrimePackets)
+	}
+	if s.opts.FanoutWorkers > 1 {
+		if err := room.splitFanout(s.opts.FanoutWorkers, s.opts.FanoutThreshold); err != nil {
+			log.Printf("Room %s fanout: %v; using one track", room.Name, err)
+			room.fanout = fanout{}
+		}
+	}
+	if limit := s.opts.MaxRoomBandwidth; limit > 0 && (room.MaxBandwidth == 0 || room.MaxBandwidth > limit) {
+		room.MaxBandwidth = limit
+	}
+
+	s.roomsMu.Lock()
+	if _, taken := s.rooms[room.Name]; taken {
+		s.roomsMu.Unlock()
+		return errRoomExists
+	}
+	if !s.underQuota(room) {
+		s.roomsMu.Unlock()
+		return errRoomQuota
+	}
+	s.rooms[room.Name] = room
+	s.countRoom(room, 1)
+	s.roomsMu.Unlock()
+	s.reserve(room)
+	return nil
+}
+
+// parseRoomOptions plus checks that depend on server configuration
+func (s *Server) roomOptions(w http.ResponseWriter, r *http.Request) (RoomOptions, optionErrors) {
+	opts, errs := parseRoomOptions(w, r)
+	if errs == nil && opts.Record && s.opts.RecordingDir == "" {
+		errs = optionErrors{"record": "recording is not enabled on this server"}
+	}
+	if errs == nil {
+		errs = s.checkOutbound(r, map[string]string{
+			"icecast_url": opts.IcecastURL,
+			"webhook_url": opts.WebhookURL,
+		})
+	}
+	return opts, errs
+}
+
+// Same checks as /create, without creating anything
+func (s *Server) validateRoom(w http.ResponseWriter, r *http.Request) {
+	if _, errs := s.roomOptions(w, r); errs != nil {
+		writeOptionErrors(w, errs)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{"valid": true})
+}
+
+// Landing response for "/" so the bare domain isn't a 404
+func (s *Server) root(w http.ResponseWriter, r *http.Request) {
+	if s.opts.RootRedirect != "" {
+		http.Redirect(w, r, s.opts.RootRedirect, http.StatusFound)
+		return
+	}
+
+	s.roomsMu.RLock()
+	rooms := len(s.rooms)
+	s.roomsMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"service": "mini-mixlr",
+		"status":  "ok",
+		"rooms":   rooms,
+	})
+}
+
+// Start the room's Icecast relay and recording, if it has them, for audio
+// that's going live; stop ends them once it's over
+func (s *Server) roomSinks(room *Room) (sinks []packetSink, stop func()) {
+	var stops []func()
+	if room.IcecastURL != "" {
+		sink := startIcecast(room.IcecastURL, room.Name, room.channels())
+		sinks = append(sinks, sink)
+		stops = append(stops, sink.close)
+	}
+	if room.Record {
+		rec, err := room.resumeRecording(s.opts.RecordingDir)
+		if err != nil {
+			log.Println("Recording error:", err)
+		} else {
+			sinks = append(sinks, room.recordingSink(rec))
+			stops = append(stops, func() { room.suspendRecording(s.opts.RecordingGrace) })
+		}
+	}
+	return sinks, func() {
+		for i := len(stops) - 1; i >= 0; i-- {
+			stops[i]()
+		}
+	}
+}
+
+// Where listeners open a room
+func roomURL(id string) string {
+	return "https://your-app.fly.dev/r/" + id
+}
+
+type lobbyEntry struct {
+	Room        string `json:"room"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Listeners   int    `json:"listeners"`
+	URL         string `json:"url"`
+}
+
+// Default Options.MaxLobbyRooms
+const defaultLobbyRooms = 50
+
+// One page of /lobby
+type lobbyPage struct {
+	Rooms []lobbyEntry `json:"rooms"`
+	// Live public rooms across all pages
+	Total int `json:"total"`
+	// Offset of the next page; absent on the last one
+	NextOffset int `json:"next_offset,omitempty"`
+}
+
+// Public rooms that are live right now, for a discovery page, busiest
+// first. ?limit= (up to Options.MaxLobbyRooms) and ?offset= page through
+// them.
+func (s *Server) lobby(w http.ResponseWriter, r *http.Request) {
+	maxRooms := s.opts.MaxLobbyRooms
+	if maxRooms <= 0 {
+		maxRooms = defaultLobbyRooms
+	}
+	limit, offset := maxRooms, 0
+	query := r.URL.Query()
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxRooms)
+	}
+	if v := query.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "offset must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	s.roomsMu.RLock()
+	entries := []lobbyEntry{}
+	for _, room := range s.rooms {
+		room.mu.RLock()
+		if room.Public && room.Broadcaster != nil {
+			entries = append(entries, lobbyEntry{
+				Room:        room.Name,
+				Title:       room.Title,
+				Description: room.Description,
+				Listeners:   len(room.Listeners),
+				URL:         roomURL(room.Name),
+			})
+		}
+		room.mu.RUnlock()
+	}
+	s.roomsMu.RUnlock()
+
+	// Room name breaks ties so pages don't shuffle between requests
+	slices.SortFunc(entries, func(a, b lobbyEntry) int {
+		if a.Listeners != b.Listeners {
+			return b.Listeners - a.Listeners
+		}
+		return strings.Compare(a.Room, b.Room)
+	})
+	page := lobbyPage{Rooms: []lobbyEntry{}, Total: len(entries)}
+	if offset < len(entries) {
+		end := min(offset+limit, len(entries))
+		page.Rooms = entries[offset:end]
+		if end < len(entries) {
+			page.NextOffset = end
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func (s *Server) listRooms(w http.ResponseWriter, r *http.Request) {
+	s.roomsMu.RLock()
+	list := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		list = append(list, room)
+	}
+	s.roomsMu.RUnlock()
+
+	infos := make([]roomInfo, 0, len(list))
+	for _, room := range list {
+		infos = append(infos, room.info())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// Whether id is usable as a room ID chosen outside /create (seed files,
+// signed tokens). IDs end up in /join/<id> paths.
+func validRoomID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, "/?#") && checkText(id, maxRoomIDLen, false) == nil
+}
+
+// Find the room a URL names, answering 400 for an implausible ID and 404
+// for an unknown one
+func (s *Server) lookupRoom(w http.ResponseWriter, r *http.Request, id string) (*Room, bool) {
+	if id == "" || len(id) > maxRoomIDLen {
+		log.Printf("Rejected room ID of %d bytes from %s", len(id), s.clientIP(r))
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return nil, false
+	}
+
+	s.roomsMu.RLock()
+	room, exists := s.rooms[id]
+	s.roomsMu.RUnlock()
+
+	if !exists {
+		http.Error(w, "Room not found", http.StatusNotFound)
+		return nil, false
+	}
+	return room, true
+}
+
+func (s *Server) getRoom(w http.ResponseWriter, r *http.Request) {
+	room, ok := s.lookupRoom(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	// Passphrase-protected rooms need the same passphrase listeners use, or admin
+	if !s.isAdmin(r) && !secretMatches(room.ListenerPassphrase, r.URL.Query().Get("passphrase")) {
+		http.Error(w, "Invalid listener passphrase", http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(room.details())
+}
+
+// Whether the request carries the admin bearer token
+func (s *Server) isAdmin(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && s.opts.AdminToken != "" && secretMatches(s.opts.AdminToken, token)
+}
+
+func (s *Server) joinRoom(w http.ResponseWriter, r *http.Request) {
+	identity, ok := s.authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	roomName := r.URL.Path[len("/join/"):]
+	room, ok := s.lookupRoom(w, r, roomName)
+	if !ok {
+		return
+	}
+
+	if token := r.URL.Query().Get("session"); token != "" {
+		s.reattachSession(w, r, room, token)
+		return
+	}
+
+	role := r.URL.Query().Get("role")
+	if role != roleBroadcaster && role != roleModerator {
+		role = roleListener
+	}
+	isBroadcaster := role == roleBroadcaster
+
+	name, err := cleanName(r.URL.Query().Get("name"))
+	if err != nil {
+		http.Error(w, "Invalid name: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Check the role's secret before upgrading so rejected peers never get a socket
+	switch role {
+	case roleBroadcaster:
+		token := r.URL.Query().Get("token")
+		if !s.mayBroadcast(room, token) {
+			http.Error(w, "Invalid broadcaster token", http.StatusForbidden)
+			return
+		}
+	case roleModerator:
+		if room.ModeratorToken == "" || !secretMatches(room.ModeratorToken, r.URL.Query().Get("token")) {
+			http.Error(w, "Invalid moderator token", http.StatusForbidden)
+			return
+		}
+	default:
+		if !secretMatches(room.ListenerPassphrase, r.URL.Query().Get("passphrase")) {
+			http.Error(w, "Invalid listener passphrase", http.StatusForbidden)
+			return
+		}
+		if !s.verifyListener(w, r) {
+			return
+		}
+	}
+
+	if !s.admit(w, r) {
+		return
+	}
+	conn := s.upgrade(w, r)
+	if conn == nil {
+		return
+	}
+	ws := newSignalConn(conn, r.URL.Query().Get("proto") == "binary")
+	defer ws.Close()
+
+	if err := s.trackConn(ws); err != nil {
+		fail(ws, codeShuttingDown, "Server is shutting down")
+		return
+	}
+	defer s.untrackConn(ws)
+
+	clientIP := s.clientIP(r)
+	if !isBroadcaster {
+		if !s.acquireIP(clientIP) {
+			log.Printf("Too many connections from %s", clientIP)
+			fail(ws, codeTooManyConnections, "Too many connections from this address")
+			return
+		}
+		defer s.releaseIP(clientIP)
+	}
+
+	config := webrtc.Configuration{ICEServers: s.iceServers()}
+
+	pc, hooks, err := s.newPeerConnectionRetry(config, room.Stereo)
+	if err != nil {
+		log.Println("PeerConnection error:", err)
+		fail(ws, codePCCreateFailed, "Could not set up the connection")
+		return
+	}
+	defer s.closePeer(pc, clientIP+" in room "+roomName)
+
+	p := &peer{
+		pc:           pc,
+		ws:           ws,
+		role:         role,
+		id:           randomHex(4),
+		joinedAt:     time.Now(),
+		senders:      make(map[string]*webrtc.RTPSender),
+		unsubscribed: make(map[string]bool),
+		pcGone:       make(chan struct{}),
+		firstTrack:   make(chan struct{}),
+		identity:     identity,
+		ip:           clientIP,
+		gate:         hooks.gate,
+		gatherFirst:  room.NoTrickleICE || s.opts.NoTrickleICE,
+	}
+	if name != "" {
+		p.name.Store(&name)
+	}
+	log.Printf("Peer %s (%s, %s) joining room %s as %s", p.id, clientIP, identity, roomName, role)
+	// The deferred teardown above still runs for this peer alone
+	defer recoverPanic(role+" "+p.id+" in room "+roomName, nil)
+	defer s.uncountConnection(p)
+
+	if isBroadcaster {
+		// Add audio track for broadcaster
+		_, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio)
+		if err != nil {
+			log.Println("AddTransceiver error:", err)
+			return
+		}
+		if r.URL.Query().Get("monitor") == "true" {
+			if err := room.attachMonitor(p); err != nil {
+				log.Println("Monitor track error:", err)
+				return
+			}
+		}
+
+		room.mu.Lock()
+		switch {
+		case room.Broadcaster == nil:
+			room.Broadcaster = pc
+			room.broadcasterWS = ws
+			room.broadcasterPeer = p
+			room.claim()
+			// The no-listeners clock only runs while someone is broadcasting
+			if len(room.Listeners) == 0 {
+				room.EmptySince = time.Now()
+			}
+			room.updateEmpty()
+		case room.mixing() && 1+len(room.coHosts) < room.MaxBroadcasters:
+			room.coHosts[pc] = p
+			log.Printf("Broadcaster %s joined the mix in room %s as a co-host", p.id, roomName)
+		case room.mixing():
+			room.mu.Unlock()
+			fail(ws, codeBroadcasterExists, "Room already has all the broadcasters it allows")
+			return
+		default:
+			room.mu.Unlock()
+			fail(ws, codeBroadcasterExists, "Room already has a broadcaster")
+			return
+		}
+		room.mu.Unlock()
+		defer func() {
+			room.mu.Lock()
+			if room.Broadcaster != pc {
+				delete(room.coHosts, pc)
+				room.mu.Unlock()
+				return
+			}
+			if next := room.promoteCoHost(); next != nil {
+				room.mu.Unlock()
+				log.Printf("Broadcaster %s took over the lead in room %s", next.id, room.Name)
+				return
+			}
+			room.Broadcaster = nil
+			room.broadcasterWS = nil
+			room.broadcasterPeer = nil
+			room.StartedAt = time.Time{}
+			room.stopEmptyTimer()
+			room.mu.Unlock()
+
+			// Listeners keep their connections; a new broadcaster's audio
+			// flows into the same room track
+			room.clearMetadata()
+			room.broadcast(map[string]string{"type": "broadcaster_left"})
+			room.publish(roomEvent{Type: eventBroadcasterLeft})
+		}()
+
+		pc.OnDataChannel(room.relayMetadata)
+
+		// When broadcaster sends a track → forward to all listeners
+		pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+			// Closing the connection ends the broadcaster's handler too
+			defer recoverPanic("track from broadcaster "+p.id+" in room "+roomName, func() { s.closePeer(pc, p.id) })
+			log.Printf("Broadcaster sent track: %s", track.Kind())
+			if track.Kind() != webrtc.RTPCodecTypeAudio {
+				return
+			}
+
+			// A live broadcaster takes over from a replay
+			if room.stopReplay() {
+				log.Printf("Broadcaster took over room %s from a replay", room.Name)
+			}
+
+			if room.mixing() {
+				p.markFirstTrack()
+				if s.opts.BandwidthEstimation {
+					go sendBroadcasterREMB(room, pc, track.SSRC())
+				}
+				room.mixer.feed(track, func() ([]packetSink, func()) { return s.roomSinks(room) })
+				return
+			}
+
+			// The first audio track feeds the main room track; any more are
+			// extra named tracks
+			room.mu.Lock()
+			isMain := !room.mainLive
+			room.mainLive = true
+			room.mu.Unlock()
+			if !isMain {
+				room.forwardExtra(track)
+				return
+			}
+			p.markFirstTrack()
+			defer func() {
+				room.mu.Lock()
+				room.mainLive = false
+				room.mu.Unlock()
+				if room.primer != nil {
+					room.primer.reset()
+				}
+			}()
+
+			room.mu.Lock()
+			started := room.StartedAt.IsZero()
+			if started {
+				room.StartedAt = time.Now()
+			}
+			room.mu.Unlock()
+			if started {
+				room.publish(roomEvent{Type: eventBroadcasterStarted})
+			}
+
+			if s.opts.BandwidthEstimation {
+				go sendBroadcasterREMB(room, pc, track.SSRC())
+			}
+
+			sinks, stopSinks := s.roomSinks(room)
+			defer stopSinks()
+			room.forward(track, sinks...)
+		})
+	} else {
+		// Listener or moderator: attach the room's audio track
+		room.assignShard(p)
+		sender, err := pc.AddTrack(room.mainTrackFor(p))
+		if err != nil {
+			log.Println("Listener AddTrack error:", err)
+			return
+		}
+		p.senders[mainTrack] = sender
+		if err := room.openMetadata(p); err != nil {
+			log.Println("Listener data channel error:", err)
+			return
+		}
+
+		// The estimator stays hooked up from the first reader, so later
+		// ones don't need it
+		p.readRTCP = func(sender *webrtc.RTPSender) { s.readListenerRTCP(p.room.Load(), p, sender, nil) }
+		if code := room.addListener(p); code != "" {
+			fail(ws, code, joinMessage(code))
+			return
+		}
+
+		p.room.Store(room)
+		room.greet(ws)
+
+		go s.readListenerRTCP(room, p, sender, hooks.estimator)
+
+		if room.IdleTimeout > 0 || room.MaxListenDuration > 0 {
+			done := make(chan struct{})
+			defer close(done)
+			go p.watchIdle(room.IdleTimeout, room.MaxListenDuration, done)
+		}
+	}
+
+	if err := s.preferCodecs(pc, room.Stereo); err != nil {
+		log.Println("SetCodecPreferences error:", err)
+		return
+	}
+
+	// Sweep up peers that upgrade but never finish signaling
+	var handshakeTimer *time.Timer
+	if s.opts.HandshakeTimeout > 0 {
+		handshakeTimer = time.AfterFunc(s.opts.HandshakeTimeout, func() {
+			log.Printf("Handshake timeout for %s in room %s", role, roomName)
+			fail(ws, codeHandshakeTimeout, "Connection was not established in time")
+		})
+		defer handshakeTimer.Stop()
+	}
+
+	var watchTrack sync.Once
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		defer recoverPanic("state change for "+role+" "+p.id+" in room "+roomName, func() { s.closePeer(pc, p.id) })
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			if handshakeTimer != nil {
+				handshakeTimer.Stop()
+			}
+			room.openGate(p, hooks.gate)
+			s.countConnection(p)
+			if isBroadcaster {
+				watchTrack.Do(func() { go s.awaitFirstTrack(room, p) })
+			}
+		case webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateFailed:
+			p.markGone()
+			// Cleanup on close, from whichever room the listener ended up in
+			if !isBroadcaster {
+				p.room.Load().removeListener(pc)
+			}
+		}
+	})
+
+	s.openSession(p, room)
+	defer s.closeSession(p)
+
+	s.handleSignaling(p, room)
+}
+
+// Once the broadcaster is connected, tell listeners it hasn't started
+// sending yet (mic permission prompts can take a while), then that it has.
+// If nothing arrives within FirstTrackTimeout the broadcaster is sent
+// {"type":"no_track"}, and we keep waiting.
+func (s *Server) awaitFirstTrack(room *Room, p *peer) {
+	select {
+	case <-p.firstTrack:
+	default:
+		room.broadcast(map[string]string{"type": statusWaiting})
+
+		var timeout <-chan time.Time
+		if s.opts.FirstTrackTimeout > 0 {
+			timer := time.NewTimer(s.opts.FirstTrackTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+	wait:
+		for {
+			select {
+			case <-p.firstTrack:
+				break wait
+			case <-timeout:
+				log.Printf("Broadcaster %s in room %s connected but sent no track", p.id, room.Name)
+				p.ws.WriteJSON(map[string]string{"type": "no_track"})
+				timeout = nil
+			case <-p.pcGone:
+				return
+			case <-p.ws.done:
+				return
+			}
+		}
+	}
+	room.broadcast(map[string]string{"type": statusReady})
+}
@@ -0,0 +1,956 @@
+package mixlr
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// A client-side peer driven over the server's signaling protocol
+type testPeer struct {
+	t    testing.TB
+	ws   *websocket.Conn
+	wsMu sync.Mutex
+	pc   *webrtc.PeerConnection
+
+	// Non-signaling messages (events, errors) in arrival order
+	events chan map[string]any
+	// First payload byte of every RTP packet received (listeners only)
+	packets chan byte
+	// Headers of the same packets
+	headers chan rtp.Header
+
+	stop chan struct{}
+}
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	t.Helper()
+	s, err := NewServer(Options{NoSTUN: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return s, srv
+}
+
+func createTestRoom(t testing.TB, srv *httptest.Server) string {
+	t.Helper()
+	resp, err := http.Get(srv.URL + "/create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return body["room"]
+}
+
+func dialTestPeer(t testing.TB, srv *httptest.Server, room, query string) *testPeer {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/join/" + room + "?" + query
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &testPeer{
+		t:       t,
+		ws:      ws,
+		pc:      pc,
+		events:  make(chan map[string]any, 64),
+		packets: make(chan byte, 1024),
+		headers: make(chan rtp.Header, 1024),
+		stop:    make(chan struct{}),
+	}
+	t.Cleanup(p.close)
+
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c != nil {
+			p.send(map[string]any{"type": "candidate", "candidate": c.ToJSON()})
+		}
+	})
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			pkt, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			if len(pkt.Payload) > 0 {
+				select {
+				case p.packets <- pkt.Payload[0]:
+				default:
+				}
+			}
+			select {
+			case p.headers <- pkt.Header:
+			default:
+			}
+		}
+	})
+
+	go p.readLoop()
+	return p
+}
+
+func (p *testPeer) send(msg any) {
+	p.wsMu.Lock()
+	defer p.wsMu.Unlock()
+	p.ws.WriteJSON(msg)
+}
+
+func (p *testPeer) readLoop() {
+	for {
+		_, data, err := p.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg map[string]any
+		if json.Unmarshal(data, &msg) != nil {
+			continue
+		}
+
+		switch msg["type"] {
+		case "offer", "answer":
+			raw, _ := json.Marshal(msg["sdp"])
+			var desc webrtc.SessionDescription
+			json.Unmarshal(raw, &desc)
+			if err := p.pc.SetRemoteDescription(desc); err != nil {
+				p.t.Errorf("SetRemoteDescription: %v", err)
+				continue
+			}
+			if desc.Type == webrtc.SDPTypeOffer {
+				answer, err := p.pc.CreateAnswer(nil)
+				if err != nil {
+					p.t.Errorf("CreateAnswer: %v", err)
+					continue
+				}
+				p.pc.SetLocalDescription(answer)
+				p.send(map[string]any{"type": "answer", "sdp": answer})
+			}
+
+		case "candidate":
+			init := webrtc.ICECandidateInit{Candidate: msg["candidate"].(string)}
+			if mid, ok := msg["sdpMid"].(string); ok {
+				init.SDPMid = &mid
+			}
+			if index, ok := msg["sdpMLineIndex"].(float64); ok {
+				i := uint16(index)
+				init.SDPMLineIndex = &i
+			}
+			p.pc.AddICECandidate(init)
+
+		default:
+			p.events <- msg
+		}
+	}
+}
+
+// Offer an Opus track and keep sending packets whose payload starts with marker
+func (p *testPeer) broadcast(marker byte) {
+	p.t.Helper()
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "test")
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if _, err := p.pc.AddTrack(track); err != nil {
+		p.t.Fatal(err)
+	}
+
+	offer, err := p.pc.CreateOffer(nil)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := p.pc.SetLocalDescription(offer); err != nil {
+		p.t.Fatal(err)
+	}
+	p.send(map[string]any{"type": "offer", "sdp": offer})
+
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+				track.WriteSample(media.Sample{Data: []byte{marker, 0, 0, 0}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+}
+
+func (p *testPeer) close() {
+	select {
+	case <-p.stop:
+		return
+	default:
+	}
+	close(p.stop)
+	p.ws.Close()
+	p.pc.Close()
+}
+
+// Wait until a packet whose payload starts with marker arrives
+func (p *testPeer) expectAudio(marker byte) {
+	p.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case got := <-p.packets:
+			if got == marker {
+				return
+			}
+		case <-timeout:
+			p.t.Fatalf("no audio with marker %d", marker)
+		}
+	}
+}
+
+// Discard packets received so far
+func (p *testPeer) drainAudio() {
+	for {
+		select {
+		case <-p.packets:
+		case <-p.headers:
+		default:
+			return
+		}
+	}
+}
+
+// The headers of the next n packets received
+func (p *testPeer) nextHeaders(n int) []rtp.Header {
+	p.t.Helper()
+	timeout := time.After(10 * time.Second)
+	headers := make([]rtp.Header, 0, n)
+	for len(headers) < n {
+		select {
+		case h := <-p.headers:
+			headers = append(headers, h)
+		case <-timeout:
+			p.t.Fatalf("got %d of %d packets", len(headers), n)
+		}
+	}
+	return headers
+}
+
+// Fail unless headers form one unbroken stream: a single SSRC, consecutive
+// sequence numbers and timestamps a frame apart
+func checkContinuous(t *testing.T, who string, headers []rtp.Header) {
+	t.Helper()
+	for i := 1; i < len(headers); i++ {
+		prev, h := headers[i-1], headers[i]
+		if h.SSRC != prev.SSRC {
+			t.Fatalf("%s: SSRC changed from %d to %d", who, prev.SSRC, h.SSRC)
+		}
+		if h.SequenceNumber != prev.SequenceNumber+1 {
+			t.Fatalf("%s: sequence %d followed %d", who, h.SequenceNumber, prev.SequenceNumber)
+		}
+		if h.Timestamp-prev.Timestamp != opusFrameTicks {
+			t.Fatalf("%s: timestamp advanced %d, want %d", who, h.Timestamp-prev.Timestamp, opusFrameTicks)
+		}
+	}
+}
+
+func (p *testPeer) expectEvent(eventType string) map[string]any {
+	p.t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case msg := <-p.events:
+			if msg["type"] == eventType {
+				return msg
+			}
+		case <-timeout:
+			p.t.Fatalf("no %q event", eventType)
+			return nil
+		}
+	}
+}
+
+func TestBroadcasterLeaveThenRejoin(t *testing.T) {
+	_, srv := newTestServer(t)
+	room := createTestRoom(t, srv)
+
+	first := dialTestPeer(t, srv, room, "role=broadcaster")
+	first.broadcast(1)
+
+	listeners := []*testPeer{
+		dialTestPeer(t, srv, room, ""),
+		dialTestPeer(t, srv, room, ""),
+	}
+	for _, l := range listeners {
+		l.expectAudio(1)
+	}
+
+	first.close()
+	for _, l := range listeners {
+		l.expectEvent("broadcaster_left")
+	}
+
+	second := dialTestPeer(t, srv, room, "role=broadcaster")
+	second.broadcast(2)
+
+	// Same listener connections pick up the new broadcaster's audio
+	for _, l := range listeners {
+		l.expectAudio(2)
+	}
+}
+
+func TestSpuriousAnswerIgnored(t *testing.T) {
+	s, srv := newTestServer(t)
+	room := createTestRoom(t, srv)
+
+	broadcaster := dialTestPeer(t, srv, room, "role=broadcaster")
+	broadcaster.broadcast(1)
+
+	listener := dialTestPeer(t, srv, room, "")
+	listener.expectAudio(1)
+
+	// Replay the answer the listener already sent; there's no offer pending
+	listener.send(map[string]any{"type": "answer", "sdp": listener.pc.LocalDescription()})
+
+	// Audio keeps flowing on the same connection
+	listener.drainAudio()
+	listener.expectAudio(1)
+
+	s.roomsMu.RLock()
+	r := s.rooms[room]
+	s.roomsMu.RUnlock()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for pc := range r.Listeners {
+		if state := pc.SignalingState(); state != webrtc.SignalingStateStable {
+			t.Errorf("listener signaling state = %s, want stable", state)
+		}
+	}
+}
+
+// Every listener gets its own outgoing SSRC, distinct from the
+// broadcaster's, and an unbroken stream on it
+func TestListenerSSRCs(t *testing.T) {
+	_, srv := newTestServer(t)
+	room := createTestRoom(t, srv)
+
+	broadcaster := dialTestPeer(t, srv, room, "role=broadcaster")
+	broadcaster.broadcast(1)
+	first := dialTestPeer(t, srv, room, "")
+	second := dialTestPeer(t, srv, room, "")
+	first.expectAudio(1)
+	second.expectAudio(1)
+	first.drainAudio()
+	second.drainAudio()
+
+	a, b := first.nextHeaders(20), second.nextHeaders(20)
+	checkContinuous(t, "first listener", a)
+	checkContinuous(t, "second listener", b)
+	if a[0].SSRC == b[0].SSRC {
+		t.Errorf("both listeners received SSRC %d", a[0].SSRC)
+	}
+	sent := broadcaster.pc.GetSenders()[0].GetParameters().Encodings[0].SSRC
+	if webrtc.SSRC(a[0].SSRC) == sent || webrtc.SSRC(b[0].SSRC) == sent {
+		t.Errorf("broadcaster's SSRC %d forwarded verbatim", sent)
+	}
+}
+
+// A new broadcaster's stream carries on from where the last one stopped
+func TestRewriterContinuity(t *testing.T) {
+	var rw rtpRewriter
+	var out []rtp.Header
+	send := func(seq uint16, ts uint32) {
+		pkt := &rtp.Packet{Header: rtp.Header{SSRC: 1, SequenceNumber: seq, Timestamp: ts}}
+		rw.rewrite(pkt)
+		out = append(out, pkt.Header)
+	}
+
+	// Starts just short of wrapping around
+	base := uint16(65534)
+	rw.rebase(&rtp.Packet{Header: rtp.Header{SequenceNumber: base, Timestamp: 1000}}, 48000)
+	for i := 0; i < 4; i++ {
+		send(base+uint16(i), 1000+uint32(i)*opusFrameTicks)
+	}
+	// Dropped while muted: the sequence closes up, time moves on
+	rw.skip()
+	send(base+5, 1000+5*opusFrameTicks)
+	checkContinuous(t, "first source", out[:4])
+	if gap := out[4].SequenceNumber - out[3].SequenceNumber; gap != 1 {
+		t.Errorf("sequence jumped %d over a skipped packet", gap)
+	}
+
+	// Second source, far behind the first in both sequence and time
+	rw.rebase(&rtp.Packet{Header: rtp.Header{SequenceNumber: 10, Timestamp: 5}}, 48000)
+	last := out[len(out)-1]
+	send(10, 5)
+	send(11, 5+opusFrameTicks)
+	resumed := out[len(out)-2]
+	if resumed.SequenceNumber != last.SequenceNumber+1 {
+		t.Errorf("second source starts at sequence %d, want %d", resumed.SequenceNumber, last.SequenceNumber+1)
+	}
+	if int32(resumed.Timestamp-last.Timestamp) <= 0 {
+		t.Errorf("second source's timestamp %d is not after %d", resumed.Timestamp, last.Timestamp)
+	}
+	checkContinuous(t, "second source", out[len(out)-2:])
+}
+
+func TestICERestartAfterRotation(t *testing.T) {
+	s, err := NewServer(Options{TURNURLs: []string{"turn:127.0.0.1:3478"}, TURNSecret: "old-secret", TURNTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	room := createTestRoom(t, srv)
+	listener := dialTestPeer(t, srv, room, "")
+	defer listener.close()
+
+	s.SetTURNSecret("new-secret")
+	listener.send(map[string]string{"type": "ice_restart"})
+	msg := listener.expectEvent("ice_servers")
+
+	raw, _ := json.Marshal(msg["ice_servers"])
+	var servers []webrtc.ICEServer
+	if err := json.Unmarshal(raw, &servers); err != nil {
+		t.Fatal(err)
+	}
+	for _, server := range servers {
+		if server.Username == "" {
+			continue
+		}
+		mac := hmac.New(sha1.New, []byte("new-secret"))
+		mac.Write([]byte(server.Username))
+		if want := base64.StdEncoding.EncodeToString(mac.Sum(nil)); server.Credential != want {
+			t.Fatalf("TURN credential %v was not minted from the rotated secret", server.Credential)
+		}
+		return
+	}
+	t.Fatalf("no TURN server in %v", msg)
+}
+
+// Unsubscribing from an extra track takes it out of the listener's next
+// offer, so the client stops expecting its media
+func TestUnsubscribeRemovesTrack(t *testing.T) {
+	s, srv := newTestServer(t)
+	room := createTestRoom(t, srv)
+
+	broadcaster := dialTestPeer(t, srv, room, "role=broadcaster")
+	music, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "music", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := broadcaster.pc.AddTrack(music); err != nil {
+		t.Fatal(err)
+	}
+	broadcaster.broadcast(1)
+
+	// The first track to arrive becomes main, so hold the music back
+	// until the broadcast's own track has
+	s.roomsMu.RLock()
+	r := s.rooms[room]
+	s.roomsMu.RUnlock()
+	eventually(t, 10*time.Second, func() bool {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.mainLive
+	}, func() string { return "main track never arrived" })
+	go func() {
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-broadcaster.stop:
+				return
+			case <-ticker.C:
+				music.WriteSample(media.Sample{Data: []byte{2, 0, 0, 0}, Duration: 20 * time.Millisecond})
+			}
+		}
+	}()
+	extra := "music"
+	eventually(t, 10*time.Second, func() bool {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return r.extraTracks[extra] != nil
+	}, func() string { return "no extra track" })
+
+	listener := dialTestPeer(t, srv, room, "")
+	offered := func() bool {
+		desc := listener.pc.RemoteDescription()
+		return desc != nil && strings.Contains(desc.SDP, " "+extra+"\r\n")
+	}
+	eventually(t, 10*time.Second, offered, func() string { return "extra track never offered" })
+
+	listener.send(map[string]string{"type": "unsubscribe", "track": extra})
+	eventually(t, 10*time.Second, func() bool { return !offered() }, func() string {
+		return "extra track still in the offer after unsubscribing"
+	})
+	eventually(t, 10*time.Second, func() bool {
+		return listener.pc.SignalingState() == webrtc.SignalingStateStable
+	}, func() string { return "renegotiation did not complete" })
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, p := range r.Listeners {
+		if p.senders[extra] != nil || !p.unsubscribed[extra] {
+			t.Errorf("listener still subscribed to %q", extra)
+		}
+	}
+}
+
+// Open file descriptors, or -1 where /proc isn't available
+func openFDs() int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(entries)
+}
+
+// Poll until cond holds, failing with describe() if it never does
+func eventually(t testing.TB, timeout time.Duration, cond func() bool, describe func() string) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(describe())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestListenerChurnNoLeaks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("churn test is slow")
+	}
+	const (
+		total    = 200
+		parallel = 20
+	)
+
+	s, srv := newTestServer(t)
+	room := createTestRoom(t, srv)
+	broadcaster := dialTestPeer(t, srv, room, "role=broadcaster")
+	broadcaster.broadcast(1)
+
+	// Warm up once so lazily started pion/http goroutines are in the baseline
+	warm := dialTestPeer(t, srv, room, "")
+	warm.expectAudio(1)
+	warm.close()
+
+	s.roomsMu.RLock()
+	r := s.rooms[room]
+	s.roomsMu.RUnlock()
+	listeners := func() int {
+		r.mu.RLock()
+		defer r.mu.RUnlock()
+		return len(r.Listeners)
+	}
+	eventually(t, 10*time.Second, func() bool { return listeners() == 0 },
+		func() string { return "warm-up listener never left" })
+
+	time.Sleep(200 * time.Millisecond)
+	baseGoroutines := runtime.NumGoroutine()
+	baseFDs := openFDs()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallel)
+	for i := 0; i < total; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			l := dialTestPeer(t, srv, room, "")
+			l.expectAudio(1)
+			l.close()
+		}()
+	}
+	wg.Wait()
+
+	eventually(t, 10*time.Second, func() bool { return listeners() == 0 },
+		func() string { return fmt.Sprintf("room still has %d listeners", listeners()) })
+
+	// Pion tears down asynchronously; allow a little slack for stragglers
+	const slack = 10
+	eventually(t, 15*time.Second, func() bool {
+		return runtime.NumGoroutine() <= baseGoroutines+slack
+	}, func() string {
+		return fmt.Sprintf("goroutines: %d after churn, %d before", runtime.NumGoroutine(), baseGoroutines)
+	})
+	if baseFDs >= 0 {
+		eventually(t, 15*time.Second, func() bool {
+			return openFDs() <= baseFDs+slack
+		}, func() string {
+			return fmt.Sprintf("open fds: %d after churn, %d before", openFDs(), baseFDs)
+		})
+	}
+
+	// The room still works for the next listener
+	next := dialTestPeer(t, srv, room, "")
+	next.expectAudio(1)
+}
+
+// Per-packet cost of forwarding a broadcaster's packet as the room grows,
+// from one track and from four shards written in parallel (see fanout.go).
+// Listeners are bound straight to the room's tracks with writers that
+// discard, so this covers reading the packet, the forwarding path and
+// pion's per-track loop, but not each listener's interceptors, SRTP and
+// socket, which would swamp it.
+func BenchmarkFanout(b *testing.B) {
+	wire, err := (&rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111}, Payload: make([]byte, 160)}).Marshal()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, listeners := range []int{10, 100, 1000} {
+		for _, bc := range []struct {
+			name    string
+			workers int
+		}{{"serial", 1}, {"pooled", 4}} {
+			b.Run(fmt.Sprintf("listeners=%d/%s", listeners, bc.name), func(b *testing.B) {
+				room, err := newRoom("bench", RoomOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+				if bc.workers > 1 {
+					if err := room.splitFanout(bc.workers, 1); err != nil {
+						b.Fatal(err)
+					}
+				}
+				for i := 0; i < listeners; i++ {
+					p := &peer{}
+					room.assignShard(p)
+					if _, err := room.mainTrackFor(p).Bind(benchBinding{id: fmt.Sprint(i), ssrc: webrtc.SSRC(i + 1)}); err != nil {
+						b.Fatal(err)
+					}
+				}
+				room.listenerCount.Store(int32(listeners))
+
+				fw := room.newFanoutWriter()
+				defer fw.close()
+				var in rtpReader
+				var src rtpSource = benchSource(wire)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					pkt, err := in.read(src)
+					if err != nil {
+						b.Fatal(err)
+					}
+					room.relay(pkt, fw, nil)
+				}
+			})
+		}
+	}
+}
+
+// Every read returns the same packet
+type benchSource []byte
+
+func (src benchSource) Read(b []byte) (int, interceptor.Attributes, error) {
+	return copy(b, src), nil, nil
+}
+
+// Binds a track to a listener that throws its packets away
+type benchBinding struct {
+	id   string
+	ssrc webrtc.SSRC
+}
+
+func (c benchBinding) CodecParameters() []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{{RTPCodecCapability: opusCapability(false), PayloadType: 111}}
+}
+func (c benchBinding) HeaderExtensions() []webrtc.RTPHeaderExtensionParameter { return nil }
+func (c benchBinding) SSRC() webrtc.SSRC                                      { return c.ssrc }
+func (c benchBinding) SSRCRetransmission() webrtc.SSRC                        { return 0 }
+func (c benchBinding) SSRCForwardErrorCorrection() webrtc.SSRC                { return 0 }
+func (c benchBinding) WriteStream() webrtc.TrackLocalWriter                   { return benchWriter{} }
+func (c benchBinding) ID() string                                             { return c.id }
+func (c benchBinding) RTCPReader() interceptor.RTCPReader                     { return nil }
+
+type benchWriter struct{}
+
+func (benchWriter) WriteRTP(header *rtp.Header, payload []byte) (int, error) {
+	return header.MarshalSize() + len(payload), nil
+}
+func (benchWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func TestClaimedRoomNeedsToken(t *testing.T) {
+	s, err := NewServer(Options{NoSTUN: true, AdminToken: "admin", TokenSecret: "0123456789abcdef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/tokens", strings.NewReader(`{"room":"show"}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var minted map[string]string
+	json.NewDecoder(resp.Body).Decode(&minted)
+	resp.Body.Close()
+
+	resp, err = http.Get(srv.URL + "/create?claim=" + minted["token"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("create with claim: %s", resp.Status)
+	}
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/join/show?role=broadcaster"
+	for _, token := range []string{"", "guess"} {
+		_, resp, err := websocket.DefaultDialer.Dial(url+"&token="+token, nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("broadcaster with token %q was not refused", token)
+		}
+	}
+	b := dialTestPeer(t, srv, "show", "role=broadcaster&token="+minted["token"])
+	b.broadcast(1)
+	dialTestPeer(t, srv, "show", "").expectAudio(1)
+}
+
+type fixedIdentity string
+
+func (f fixedIdentity) Authenticate(*http.Request) (*Identity, error) {
+	return &Identity{Subject: string(f)}, nil
+}
+
+func TestIdleRoomFreesQuota(t *testing.T) {
+	s, err := NewServer(Options{
+		NoSTUN:          true,
+		Authenticator:   fixedIdentity("alice"),
+		MaxRoomsPerUser: 1,
+		RoomIdleTimeout: 200 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+
+	room := createTestRoom(t, srv)
+	b := dialTestPeer(t, srv, room, "role=broadcaster")
+	b.broadcast(1)
+	resp, err := http.Get(srv.URL + "/create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("second room while the first is live: %s", resp.Status)
+	}
+
+	b.ws.Close()
+	eventually(t, 5*time.Second, func() bool {
+		s.roomsMu.Lock()
+		defer s.roomsMu.Unlock()
+		return s.rooms[room] == nil
+	}, func() string { return "ended room was never removed" })
+	createTestRoom(t, srv)
+}
+
+// A track that ended before its first packet leaves a recording of headers
+// alone; looping it must neither spin forever nor block a broadcaster
+func TestHeaderOnlyReplayEnds(t *testing.T) {
+	dir := t.TempDir()
+	ogg, err := oggwriter.New(filepath.Join(dir, "empty.ogg"), 48000, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ogg.Close()
+
+	s, err := NewServer(Options{NoSTUN: true, AdminToken: "admin", RecordingDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	room := createTestRoom(t, srv)
+
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/rooms/"+room+"/replay",
+		strings.NewReader(`{"file":"empty.ogg","loop":true}`))
+	req.Header.Set("Authorization", "Bearer admin")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("replay: %s", resp.Status)
+	}
+
+	b := dialTestPeer(t, srv, room, "role=broadcaster")
+	b.broadcast(1)
+	dialTestPeer(t, srv, room, "").expectAudio(1)
+}
+
+// Jitter buffering in the mixer: inputs are heard once prebuffered, drop
+// out on underrun until they've buffered up again, and never queue more
+// than mixMaxBuffer frames
+func TestMixerBuffering(t *testing.T) {
+	const frame = opusFrameTicks
+	m := newMixer(nil)
+	sum := make([]int32, frame)
+	frames := func(n int, value func(i int) int16) []int16 {
+		pcm := make([]int16, n*frame)
+		for i := range pcm {
+			pcm[i] = value(i / frame)
+		}
+		return pcm
+	}
+	level := func(v int16) func(int) int16 { return func(int) int16 { return v } }
+	expect := func(want int32) {
+		t.Helper()
+		if !m.take(sum) {
+			t.Fatal("take reported no inputs")
+		}
+		for i, v := range sum {
+			if v != want {
+				t.Fatalf("sample %d is %d, want %d", i, v, want)
+			}
+		}
+	}
+
+	if m.take(sum) {
+		t.Fatal("take with no inputs")
+	}
+	a, b := &mixInput{}, &mixInput{}
+	m.inputs[a] = struct{}{}
+	m.inputs[b] = struct{}{}
+
+	a.push(frames(mixPrebuffer-1, level(100)), frame)
+	expect(0) // still prebuffering
+	a.push(frames(1, level(100)), frame)
+	b.push(frames(mixPrebuffer, level(50)), frame)
+	for range mixPrebuffer {
+		expect(150)
+	}
+	// Both have run dry, and stay out until they've prebuffered again
+	expect(0)
+	a.push(frames(1, level(100)), frame)
+	expect(0)
+
+	// An input that gets ahead loses its oldest frames
+	m.inputs = map[*mixInput]struct{}{b: {}}
+	b.push(frames(mixMaxBuffer+2, func(i int) int16 { return int16(i) }), frame)
+	if len(b.pcm) != mixMaxBuffer*frame {
+		t.Fatalf("buffered %d samples, want %d", len(b.pcm), mixMaxBuffer*frame)
+	}
+	expect(2)
+}
+
+// Stand-in codec for transcoder tests. A packet is {level, length in 10ms
+// steps} and decodes to that many samples at that level; a lost one is
+// concealed as -1s. An encoded frame is its first and last sample.
+type fakeCodec struct{}
+
+func (fakeCodec) decode(packet []byte, pcm []int16) (int, error) {
+	if packet == nil {
+		for i := range pcm {
+			pcm[i] = -1
+		}
+		return len(pcm), nil
+	}
+	n := int(packet[1]) * opusFrameTicks / 2
+	for i := range n {
+		pcm[i] = int16(packet[0])
+	}
+	return n, nil
+}
+
+func (fakeCodec) encode(pcm []int16, out []byte) (int, error) {
+	out[0], out[1] = byte(pcm[0]), byte(pcm[len(pcm)-1])
+	return 2, nil
+}
+
+func (fakeCodec) close() {}
+
+func TestTranscoder(t *testing.T) {
+	tc := newTranscoderWith(1, fakeCodec{}, fakeCodec{})
+	var got []string
+	emit := func(pkt *rtp.Packet) {
+		got = append(got, fmt.Sprintf("%d@%d:%d,%d", pkt.SequenceNumber, pkt.Timestamp,
+			int8(pkt.Payload[0]), int8(pkt.Payload[1])))
+	}
+	send := func(seq uint16, level, tens byte) {
+		pkt := &rtp.Packet{Header: rtp.Header{SequenceNumber: seq, Timestamp: 5000 + uint32(seq-100)*480}, Payload: []byte{level, tens}}
+		if err := tc.process(pkt, emit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(100, 1, 1) // half a frame: nothing yet
+	send(101, 2, 3) // split across two frames
+	send(103, 3, 2) // 102 lost: concealed at 101's length
+	send(102, 9, 2) // late: dropped
+	send(104, 4, 2) // in order after all, so nothing concealed
+	want := []string{
+		"100@5000:1,2",
+		"101@5960:2,2",
+		"102@6920:-1,-1",
+		"103@7880:-1,3",
+		"104@8840:3,4",
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("emitted %v, want %v", got, want)
+	}
+}
+
+func TestBitrateWatch(t *testing.T) {
+	room := &Room{LowBitrateKbps: 8, LowBitrateWindow: 3 * time.Second}
+	start := time.Now()
+	at := func(s int) time.Time { return start.Add(time.Duration(s) * time.Second) }
+	expect := func(w *bitrateWatch, s, n, wantKbps int, wantCrossed bool) {
+		t.Helper()
+		kbps, crossed := w.add(at(s), n)
+		if kbps != wantKbps || crossed != wantCrossed {
+			t.Fatalf("at %ds: %d kbit/s, crossed %v; want %d, %v", s, kbps, crossed, wantKbps, wantCrossed)
+		}
+	}
+
+	// 3000 bytes a second is 24 kbit/s, then nothing: the empty checks a
+	// stall makes bring it under the floor
+	w := room.newBitrateWatch()
+	for s := range 3 {
+		expect(w, s, 3000, 0, false)
+	}
+	expect(w, 3, 0, 24, false)
+	expect(w, 4, 0, 16, false)
+	expect(w, 5, 0, 8, false)
+	expect(w, 6, 0, 0, true)
+
+	// A gap longer than the window still counts the second before it
+	w = room.newBitrateWatch()
+	expect(w, 0, 3000, 0, false)
+	expect(w, 10, 0, 8, false)
+}
@@ -0,0 +1,224 @@
+package mixlr
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// Signaling and media fail independently, especially on mobile: the
+// WebSocket can drop while the peer connection carries on. Each peer gets
+// a session token, and for ReattachWindow after its socket drops a client
+// can connect to /join/<room>?session=<token> and pick up the same peer
+// connection instead of starting over.
+type session struct {
+	token string
+	// Changes when the listener migrates; guarded by s.sessionsMu
+	room *Room
+	p    *peer
+	// Hands a reattached socket to the peer's signaling loop
+	reattach chan *websocket.Conn
+}
+
+// Issue the peer a session token, if reattaching is enabled
+func (s *Server) openSession(p *peer, room *Room) {
+	if s.opts.ReattachWindow <= 0 {
+		return
+	}
+	sess := &session{
+		token:    randomHex(16),
+		room:     room,
+		p:        p,
+		reattach: make(chan *websocket.Conn, 1),
+	}
+	s.sessionsMu.Lock()
+	s.sessions[sess.token] = sess
+	s.sessionsMu.Unlock()
+	p.session = sess
+
+	p.ws.WriteJSON(map[string]any{
+		"type":            "session",
+		"token":           sess.token,
+		"reattach_window": s.opts.ReattachWindow.Seconds(),
+	})
+}
+
+func (s *Server) closeSession(p *peer) {
+	if p.session == nil {
+		return
+	}
+	s.sessionsMu.Lock()
+	delete(s.sessions, p.session.token)
+	s.sessionsMu.Unlock()
+
+	// A reattach that arrived too late
+	select {
+	case conn := <-p.session.reattach:
+		conn.Close()
+	default:
+	}
+}
+
+// Called when the peer's socket fails. Waits up to ReattachWindow for the
+// client to come back on a new socket; true if it did.
+func (s *Server) awaitReattach(p *peer) bool {
+	sess := p.session
+	if sess == nil || p.ws.closed.Load() {
+		return false
+	}
+	switch p.pc.ConnectionState() {
+	case webrtc.PeerConnectionStateClosed, webrtc.PeerConnectionStateFailed:
+		return false
+	}
+
+	log.Printf("Peer %s lost signaling, waiting %s to reattach", p.id, s.opts.ReattachWindow)
+	timer := time.NewTimer(s.opts.ReattachWindow)
+	defer timer.Stop()
+
+	select {
+	case conn := <-sess.reattach:
+		if !p.ws.rebind(conn) {
+			return false
+		}
+		log.Printf("Peer %s reattached signaling in room %s", p.id, sess.room.Name)
+		p.ws.WriteJSON(map[string]any{"type": "session", "token": sess.token, "reattached": true})
+		return true
+	case <-timer.C:
+		return false
+	case <-p.ws.done:
+		return false
+	case <-p.pcGone:
+		// Media went too; nothing left to reattach to
+		return false
+	}
+}
+
+// Handle /join/<room>?session=<token>: hand a fresh socket to the session's
+// waiting signaling loop
+func (s *Server) reattachSession(w http.ResponseWriter, r *http.Request, room *Room, token string) {
+	s.sessionsMu.Lock()
+	sess := s.sessions[token]
+	known := sess != nil && sess.room == room
+	s.sessionsMu.Unlock()
+
+	if !known {
+		http.Error(w, "Unknown or expired session", http.StatusNotFound)
+		return
+	}
+
+	conn := s.upgrade(w, r)
+	if conn == nil {
+		return
+	}
+
+	old := sess.p.ws.conn.Load()
+	select {
+	case sess.reattach <- conn:
+	default:
+		// Another reattach is already pending
+		conn.Close()
+		return
+	}
+	// The old socket may still look open (a half-dead TCP connection on a
+	// phone); closing it sends the signaling loop to pick up the new one
+	old.Close()
+}
+
+// Handle GET /rooms/{id}/sessions: every connection in the room, for
+// moderation tooling. Admin only, since it exposes client IPs.
+func (s *Server) listSessions(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+	room, ok := s.lookupRoom(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	peers := room.peers()
+	sessions := make([]map[string]any, 0, len(peers))
+	for _, p := range peers {
+		info := map[string]any{
+			"id":        p.id,
+			"role":      p.role,
+			"ip":        p.ip,
+			"joined_at": p.joinedAt.UTC().Format(time.RFC3339),
+		}
+		if p.identity != nil {
+			info["subject"] = p.identity.Subject
+		}
+		if name := p.displayName(); name != "" {
+			info["name"] = name
+		}
+		if q := p.quality.Load(); q > 0 {
+			info["quality"] = q
+		}
+		sessions = append(sessions, info)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// Handle DELETE /rooms/{id}/sessions/{sid}: disconnect one peer. It's told
+// {"type":"kicked"} first; reattaching isn't possible afterwards.
+func (s *Server) revokeSession(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+	room, ok := s.lookupRoom(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+
+	p := room.peerByID(r.PathValue("sid"))
+	if p == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Peer %s (%s) kicked from room %s by admin", p.id, p.role, room.Name)
+	p.ws.WriteJSON(map[string]string{"type": "kicked"})
+	// Closing the socket (not just the conn) rules out a reattach
+	p.ws.CloseWith(websocket.ClosePolicyViolation, "Kicked by an administrator")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Handle GET /rooms/{id}/sessions/{sid}/stats: pion's full stats report for
+// one peer connection, keyed by stats ID, for digging into a single
+// problem connection. Admin only.
+func (s *Server) sessionStats(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+	room, ok := s.lookupRoom(w, r, r.PathValue("id"))
+	if !ok {
+		return
+	}
+	p := room.peerByID(r.PathValue("sid"))
+	if p == nil {
+		http.Error(w, "Session not found", http.StatusNotFound)
+		return
+	}
+
+	report := p.pc.GetStats()
+	stats := make(map[string]json.RawMessage, len(report))
+	for id, stat := range report {
+		// One stat that won't encode (a NaN, say) shouldn't cost the rest
+		encoded, err := json.Marshal(stat)
+		if err != nil {
+			log.Printf("Stats %s for peer %s: %v", id, p.id, err)
+			continue
+		}
+		stats[id] = encoded
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,498 @@
+package mixlr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+)
+
+// gorilla/websocket allows one concurrent writer, but pion callbacks and
+// other peers' joins write from their own goroutines
+type signalConn struct {
+	// The current socket. A client may reattach a new one to the same
+	// session (see session.go), so everything holds the signalConn instead.
+	conn atomic.Pointer[websocket.Conn]
+	mu   sync.Mutex
+
+	// Client negotiated the binary protocol (see binary.go)
+	binary bool
+
+	// Set once the handler is done with the socket. Pion callbacks
+	// (OnICECandidate, room events) can outlive it and must not write.
+	closed atomic.Bool
+	done   chan struct{}
+}
+
+var errConnClosed = errors.New("signaling connection closed")
+
+// Signaling protocol versions we speak, as WebSocket subprotocols. A client
+// that asks for none gets the current one; a client that asks only for
+// versions we don't know is closed with CloseProtocolError.
+const protocolV1 = "mixlr-v1"
+
+var subprotocols = []string{protocolV1}
+
+// Upgrade to a signaling socket, enforcing subprotocol negotiation.
+// Returns nil if the upgrade failed or the socket was refused.
+func (s *Server) upgrade(w http.ResponseWriter, r *http.Request) *websocket.Conn {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("Upgrade error:", err)
+		return nil
+	}
+	if requested := websocket.Subprotocols(r); len(requested) > 0 && conn.Subprotocol() == "" {
+		log.Printf("Refusing unsupported signaling protocols %v", requested)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported protocol, expected "+strings.Join(subprotocols, " or ")),
+			time.Now().Add(time.Second))
+		conn.Close()
+		return nil
+	}
+	return conn
+}
+
+func newSignalConn(conn *websocket.Conn, binary bool) *signalConn {
+	c := &signalConn{binary: binary, done: make(chan struct{})}
+	c.conn.Store(conn)
+	return c
+}
+
+// How long a close frame may take to write before we just drop the socket
+const closeFrameTimeout = 250 * time.Millisecond
+
+// Close with a normal-closure frame
+func (c *signalConn) Close() error {
+	return c.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// Close with the given close code and reason. Only the first close counts,
+// so the deferred Close in a handler doesn't override a specific one.
+func (c *signalConn) CloseWith(code int, reason string) error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+	close(c.done)
+	// Not under mu: WriteControl is safe alongside other writers, and
+	// closing the conn is what unblocks a stuck one
+	conn := c.conn.Load()
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(closeFrameTimeout))
+	return conn.Close()
+}
+
+// Swap in a reattached socket. False (and conn closed) if c is already closed.
+func (c *signalConn) rebind(conn *websocket.Conn) bool {
+	c.mu.Lock()
+	c.conn.Store(conn)
+	c.mu.Unlock()
+
+	if c.closed.Load() {
+		conn.Close()
+		return false
+	}
+	return true
+}
+
+func (c *signalConn) WriteJSON(v any) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed.Load() {
+		return errConnClosed
+	}
+	conn := c.conn.Load()
+	if !c.binary {
+		return conn.WriteJSON(v)
+	}
+	msg, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.WriteMessage(websocket.BinaryMessage, encodeFrame(msg))
+}
+
+// Read the next signaling message as JSON, whichever protocol the client speaks
+func (c *signalConn) ReadSignal() ([]byte, error) {
+	for {
+		messageType, msg, err := c.conn.Load().ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		if messageType != websocket.BinaryMessage {
+			return msg, nil
+		}
+		msg, err = decodeFrame(msg)
+		if err != nil {
+			log.Println("Binary signaling error:", err)
+			continue
+		}
+		return msg, nil
+	}
+}
+
+func (s *Server) handleSignaling(p *peer, room *Room) {
+	ws, pc := p.ws, p.pc
+	isBroadcaster := p.role == roleBroadcaster
+
+	// Send ICE candidates, unless they all go in the SDP (see trickle.go)
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		if c == nil || p.gatherFirst {
+			return
+		}
+		ws.WriteJSON(map[string]any{
+			"type":          "candidate",
+			"candidate":     c.ToJSON().Candidate,
+			"sdpMid":        c.ToJSON().SDPMid,
+			"sdpMLineIndex": c.ToJSON().SDPMLineIndex,
+		})
+	})
+
+	// Listeners answer, so the server makes the offer
+	if !isBroadcaster {
+		var err error
+		s.negotiate(func() { err = p.offer(room) })
+		if err != nil {
+			log.Println("Offer error:", err)
+			return
+		}
+	}
+
+	var offers rateWindow
+	// Broadcasters are told once that video won't be relayed
+	videoRejected := false
+	messages := tokenBucket{rate: float64(s.opts.MessageRate), burst: float64(s.opts.MessageBurst)}
+	if messages.burst < 1 {
+		messages.burst = messages.rate
+	}
+
+	// Handle incoming messages
+	for {
+		msg, err := ws.ReadSignal()
+		if err != nil {
+			log.Println("WebSocket read error:", err)
+			if s.awaitReattach(p) {
+				continue
+			}
+			break
+		}
+
+		p.touch()
+
+		if s.opts.MessageRate > 0 && !messages.take() {
+			log.Printf("Message flood from %s in room %s, closing connection", p.role, room.Name)
+			fail(ws, codeRateLimited, "Too many messages")
+			return
+		}
+
+		var msgMap map[string]json.RawMessage
+		if json.Unmarshal(msg, &msgMap) != nil {
+			continue
+		}
+
+		var msgType string
+		if json.Unmarshal(msgMap["type"], &msgType) != nil {
+			continue
+		}
+
+		switch msgType {
+		case "offer":
+			if !isBroadcaster {
+				sendUnexpected(ws, msgType, "answer")
+				continue
+			}
+			if p.staleSDP(msgMap) {
+				log.Printf("Ignoring stale offer from broadcaster %s in room %s", p.id, room.Name)
+				sendError(ws, codeStaleSDP, "Offer is older than the current negotiation")
+				continue
+			}
+			if s.opts.RenegotiationLimit > 0 && !offers.allow(s.opts.RenegotiationLimit, s.opts.RenegotiationWindow) {
+				log.Println("Renegotiation flood, closing connection")
+				fail(ws, codeRenegotiationFlood, "Too many renegotiations")
+				return
+			}
+			var offer webrtc.SessionDescription
+			if json.Unmarshal(msgMap["sdp"], &offer) != nil {
+				continue
+			}
+			maxBitrate := s.opts.MaxBroadcastBitrate
+			if maxBitrate > 0 {
+				var capped bool
+				if offer.SDP, capped = capBandwidth(offer.SDP, maxBitrate); capped {
+					log.Printf("Capped bandwidth in offer from broadcaster %s in room %s to %d bits/s", p.id, room.Name, maxBitrate)
+				}
+			}
+			var answer webrtc.SessionDescription
+			var err error
+			s.negotiate(func() { answer, err = answerOffer(pc, offer, room.answerOptions(), p.gatherFirst) })
+			if err != nil {
+				log.Println("Answer error:", err)
+				continue
+			}
+			p.appliedSDP(msgMap)
+			if maxBitrate > 0 {
+				// Only the copy sent to the browser; pion's local
+				// description doesn't need it
+				answer.SDP = addBandwidth(answer.SDP, maxBitrate)
+			}
+			ws.WriteJSON(map[string]any{"type": "answer", "sdp": answer})
+			// Only Opus is negotiated, so the answer rejects any video
+			// section and audio carries on without it
+			if !videoRejected && offersVideo(offer) {
+				videoRejected = true
+				log.Printf("Broadcaster %s in room %s offered video; audio only", p.id, room.Name)
+				ws.WriteJSON(map[string]string{"type": "video_unavailable"})
+			}
+
+		case "answer":
+			if isBroadcaster {
+				sendUnexpected(ws, msgType, "offer")
+				continue
+			}
+			if p.staleSDP(msgMap) {
+				log.Printf("Ignoring stale answer from %s in room %s", p.id, room.Name)
+				sendError(ws, codeStaleSDP, "Answer is not for the current offer")
+				continue
+			}
+			var answer webrtc.SessionDescription
+			if json.Unmarshal(msgMap["sdp"], &answer) != nil {
+				continue
+			}
+			// Only an answer to our outstanding offer is valid; a late or
+			// duplicate one would knock the state machine over
+			if state := pc.SignalingState(); state != webrtc.SignalingStateHaveLocalOffer {
+				log.Printf("Ignoring answer in room %s: no pending offer (state %s)", room.Name, state)
+				continue
+			}
+			var err error
+			s.negotiate(func() { err = pc.SetRemoteDescription(answer) })
+			if err != nil {
+				log.Println("SetRemoteDescription error:", err)
+			}
+
+		case "candidate":
+			var candidate webrtc.ICECandidateInit
+			if json.Unmarshal(msgMap["candidate"], &candidate) != nil {
+				continue
+			}
+			pc.AddICECandidate(candidate)
+
+		case "ice_restart":
+			s.restartICE(p, room)
+
+		case "leave":
+			// A deliberate goodbye, so don't hold the session open for a reattach
+			return
+
+		case "whoami":
+			// Listener self-diagnostics
+			if isBroadcaster {
+				continue
+			}
+			ws.WriteJSON(p.whoami(room.Name))
+
+		case "subscribe", "unsubscribe":
+			if isBroadcaster {
+				continue
+			}
+			var name string
+			if json.Unmarshal(msgMap["track"], &name) != nil {
+				continue
+			}
+			if room.setSubscribed(p, name, msgType == "subscribe") {
+				go p.renegotiate(room)
+			}
+
+		case "set_name":
+			var name string
+			if json.Unmarshal(msgMap["name"], &name) != nil {
+				continue
+			}
+			if err := p.setName(name); err != nil {
+				sendError(ws, codeInvalidName, "Name "+err.Error())
+				continue
+			}
+			room.broadcast(map[string]string{"type": "name_changed", "id": p.id, "name": p.displayName()})
+
+		case "report":
+			if isBroadcaster {
+				continue
+			}
+			var issue string
+			if json.Unmarshal(msgMap["issue"], &issue) != nil || !reportIssues[issue] {
+				sendError(ws, codeInvalidReport, "issue must be no_audio, choppy or delay")
+				continue
+			}
+			room.report(p, issue)
+
+		case "room_state":
+			if !p.canModerate() {
+				continue
+			}
+			ws.WriteJSON(room.state())
+
+		case "mute", "unmute":
+			if !p.canModerate() {
+				continue
+			}
+			if room.setMuted(msgType == "mute") {
+				log.Printf("Room %s %sd by %s", room.Name, msgType, p.role)
+			}
+
+		case "pause", "resume":
+			if !p.canModerate() {
+				continue
+			}
+			if room.setPaused(msgType == "pause") {
+				log.Printf("Room %s %sd by %s", room.Name, msgType, p.role)
+			}
+
+		case "migrate":
+			if p.role != roleListener {
+				continue
+			}
+			room = s.migrate(p, room, msgMap)
+		}
+	}
+}
+
+// Apply a remote offer and produce our answer, with every candidate in it
+// if gather is set
+func answerOffer(pc *webrtc.PeerConnection, offer webrtc.SessionDescription, options *webrtc.AnswerOptions, gather bool) (webrtc.SessionDescription, error) {
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return offer, fmt.Errorf("SetRemoteDescription: %w", err)
+	}
+	answer, err := pc.CreateAnswer(options)
+	if err != nil {
+		return answer, fmt.Errorf("CreateAnswer: %w", err)
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return answer, fmt.Errorf("SetLocalDescription: %w", err)
+	}
+	if gather {
+		return gatheredDescription(pc)
+	}
+	return answer, nil
+}
+
+// Run SDP work (parsing, answering, applying descriptions) within the
+// MaxNegotiations limit, so a crowd joining at once queues instead of
+// spiking CPU. Skips fn if the server shuts down while queued.
+func (s *Server) negotiate(fn func()) {
+	if s.negotiations != nil {
+		select {
+		case s.negotiations <- struct{}{}:
+		case <-s.quit:
+			return
+		}
+		defer func() { <-s.negotiations }()
+	}
+	fn()
+}
+
+// Whether an offer has a live (non-zero port) video section
+func offersVideo(desc webrtc.SessionDescription) bool {
+	parsed, err := desc.Unmarshal()
+	if err != nil {
+		return false
+	}
+	for _, m := range parsed.MediaDescriptions {
+		if m.MediaName.Media == "video" && m.MediaName.Port.Value != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Sliding-window counter of events on a single connection
+type rateWindow struct {
+	times []time.Time
+}
+
+// Records an event and reports whether it stays within limit per window
+func (rw *rateWindow) allow(limit int, window time.Duration) bool {
+	now := time.Now()
+	kept := rw.times[:0]
+	for _, t := range rw.times {
+		if now.Sub(t) < window {
+			kept = append(kept, t)
+		}
+	}
+	rw.times = append(kept, now)
+	return len(rw.times) <= limit
+}
+
+// Token bucket refilled at rate per second, holding at most burst tokens
+type tokenBucket struct {
+	rate, burst float64
+	tokens      float64
+	last        time.Time
+}
+
+// Spends a token if one is available
+func (tb *tokenBucket) take() bool {
+	now := time.Now()
+	if tb.last.IsZero() {
+		tb.tokens = tb.burst
+	} else {
+		tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	}
+	tb.last = now
+
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+func sendOffer(ws *signalConn, pc *webrtc.PeerConnection, options *webrtc.OfferOptions, seq uint32, gather bool) error {
+	offer, err := pc.CreateOffer(options)
+	if err != nil {
+		return err
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	if gather {
+		if offer, err = gatheredDescription(pc); err != nil {
+			return err
+		}
+	}
+	return ws.WriteJSON(map[string]any{"type": "offer", "sdp": offer, "seq": seq})
+}
+
+// Offers and answers may carry a "seq" so a delayed one can't knock the
+// connection back to an earlier negotiation. Our offers to listeners are
+// numbered, and an answer must echo the latest; a broadcaster numbers its
+// own offers, and each must be higher than the last one applied (any seq,
+// 0 included, will do for the first). Descriptions without a seq are taken
+// as before.
+func (p *peer) staleSDP(msg map[string]json.RawMessage) bool {
+	var seq uint32
+	if json.Unmarshal(msg["seq"], &seq) != nil {
+		return false
+	}
+	if p.role != roleBroadcaster {
+		return seq != p.sdpSeq.Load()
+	}
+	return p.sdpSeqSeen && seq <= p.sdpSeq.Load()
+}
+
+// Record the seq of a broadcaster offer once it has been applied, so one
+// turned away by the rate limit or failing negotiation doesn't use it up
+func (p *peer) appliedSDP(msg map[string]json.RawMessage) {
+	var seq uint32
+	if json.Unmarshal(msg["seq"], &seq) != nil {
+		return
+	}
+	p.sdpSeq.Store(seq)
+	p.sdpSeqSeen = true
+}
@@ -0,0 +1,137 @@
+package mixlr
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A room's configuration, as exported by /rooms/export and read back from
+// Options.SeedFile. Live state (peers, tracks, recordings) isn't kept.
+type roomSnapshot struct {
+	ID        string            `json:"id"`
+	CreatedAt time.Time         `json:"created_at"`
+	Options   map[string]string `json:"options"`
+}
+
+// The room's options in /create form, so restoring runs the same parsers
+func (o RoomOptions) values() map[string]string {
+	v := map[string]string{
+		"max_listeners":            strconv.Itoa(o.MaxListeners),
+		"max_bandwidth":            strconv.Itoa(o.MaxBandwidth),
+		"max_broadcasters":         strconv.Itoa(o.MaxBroadcasters),
+		"stereo":                   strconv.FormatBool(o.Stereo),
+		"voice_activity_detection": strconv.FormatBool(o.VoiceActivityDetection),
+		"no_trickle_ice":           strconv.FormatBool(o.NoTrickleICE),
+		"public":                   strconv.FormatBool(o.Public),
+		"reserved":                 strconv.FormatBool(o.Reserved),
+		"record":                   strconv.FormatBool(o.Record),
+		"record_when_listened":     strconv.FormatBool(o.RecordWhenListened),
+		"empty_timeout":            o.EmptyTimeout.String(),
+		"idle_timeout":             o.IdleTimeout.String(),
+		"max_listen_duration":      o.MaxListenDuration.String(),
+		"low_bitrate_kbps":         strconv.Itoa(o.LowBitrateKbps),
+		"low_bitrate_window":       o.LowBitrateWindow.String(),
+	}
+	for field, s := range map[string]string{
+		"broadcaster_token":   o.BroadcasterToken,
+		"listener_passphrase": o.ListenerPassphrase,
+		"moderator_token":     o.ModeratorToken,
+		"title":               o.Title,
+		"description":         o.Description,
+		"icecast_url":         o.IcecastURL,
+		"webhook_url":         o.WebhookURL,
+		"webhook_secret":      o.WebhookSecret,
+		"empty_action":        o.EmptyAction,
+		"record_format":       o.RecordFormat,
+		"audio_mode":          o.AudioMode,
+		"metadata":            string(o.Metadata),
+	} {
+		if s != "" {
+			v[field] = s
+		}
+	}
+	return v
+}
+
+// Handle GET /rooms/export: every room's configuration, secrets included,
+// so admin only
+func (s *Server) exportRooms(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+
+	s.roomsMu.RLock()
+	snapshots := make([]roomSnapshot, 0, len(s.rooms))
+	for id, room := range s.rooms {
+		snapshots = append(snapshots, roomSnapshot{
+			ID:        id,
+			CreatedAt: room.CreatedAt,
+			Options:   room.options.values(),
+		})
+	}
+	s.roomsMu.RUnlock()
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].ID < snapshots[j].ID })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshots)
+}
+
+// Recreate the rooms in an export file, e.g. after a deploy. Any invalid
+// room fails the whole load so a bad file isn't half applied.
+func (s *Server) seedRooms(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snapshots []roomSnapshot
+	if err := json.Unmarshal(data, &snapshots); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	rooms := make(map[string]*Room, len(snapshots))
+	for _, snap := range snapshots {
+		if !validRoomID(snap.ID) {
+			return fmt.Errorf("%s: invalid room id %q", path, snap.ID)
+		}
+		if _, dup := rooms[snap.ID]; dup {
+			return fmt.Errorf("%s: duplicate room id %q", path, snap.ID)
+		}
+
+		opts := defaultRoomOptions()
+		for field, v := range snap.Options {
+			set, ok := roomOptionFields[field]
+			if !ok {
+				return fmt.Errorf("%s: room %s: unknown option %q", path, snap.ID, field)
+			}
+			if err := set(&opts, v); err != nil {
+				return fmt.Errorf("%s: room %s: %s %v", path, snap.ID, field, err)
+			}
+		}
+		if opts.Record && s.opts.RecordingDir == "" {
+			return fmt.Errorf("%s: room %s: record needs a recording directory", path, snap.ID)
+		}
+
+		room, err := newRoom(snap.ID, opts)
+		if err != nil {
+			return err
+		}
+		if !snap.CreatedAt.IsZero() {
+			room.CreatedAt = snap.CreatedAt
+		}
+		room.seeded = true
+		rooms[snap.ID] = room
+	}
+
+	for _, room := range rooms {
+		s.addRoom(room)
+	}
+	log.Printf("Seeded %d rooms from %s", len(rooms), path)
+	return nil
+}
@@ -0,0 +1,146 @@
+package mixlr
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Broadcaster tokens minted ahead of time with POST /tokens, for shows
+// provisioned separately from their rooms. A token names one room ID and
+// is signed with Options.TokenSecret, so the server needn't remember it:
+// /create?claim=<token> creates that room, and the token is accepted as
+// the broadcaster token when joining it.
+//
+// Format: base64url(JSON claims) "." base64url(HMAC-SHA256 of the first part)
+type broadcasterClaims struct {
+	Room string `json:"room"`
+	// Unix seconds
+	Exp int64 `json:"exp"`
+}
+
+const (
+	defaultTokenTTL = 24 * time.Hour
+	maxTokenTTL     = 30 * 24 * time.Hour
+)
+
+func (s *Server) signToken(claims broadcasterClaims) string {
+	payload, _ := json.Marshal(claims)
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.tokenMAC(encoded))
+}
+
+func (s *Server) tokenMAC(encoded string) []byte {
+	mac := hmac.New(sha256.New, []byte(s.opts.TokenSecret))
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// Check a token's signature and expiry and return its claims
+func (s *Server) verifyToken(token string, now time.Time) (broadcasterClaims, error) {
+	var claims broadcasterClaims
+	if s.opts.TokenSecret == "" {
+		return claims, errors.New("signed tokens are not enabled")
+	}
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, errors.New("malformed token")
+	}
+	given, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(given, s.tokenMAC(encoded)) {
+		return claims, errors.New("bad signature")
+	}
+	if err := decodeSegment(encoded, &claims); err != nil {
+		return claims, errors.New("malformed token")
+	}
+	if now.After(time.Unix(claims.Exp, 0)) {
+		return claims, errors.New("token expired")
+	}
+	return claims, nil
+}
+
+// Whether token is a valid signed token for room. Never true when signed
+// tokens aren't enabled.
+func (s *Server) tokenClaimsRoom(token, room string) bool {
+	if s.opts.TokenSecret == "" || token == "" {
+		return false
+	}
+	claims, err := s.verifyToken(token, time.Now())
+	return err == nil && claims.Room == room
+}
+
+// Whether token lets its bearer broadcast in room: the room's own
+// broadcaster token or a signed token for it. A room created from a claim
+// token without a broadcaster token of its own takes signed tokens only,
+// rather than anyone.
+func (s *Server) mayBroadcast(room *Room, token string) bool {
+	if s.tokenClaimsRoom(token, room.Name) {
+		return true
+	}
+	if room.tokenBound && room.BroadcasterToken == "" {
+		return false
+	}
+	return secretMatches(room.BroadcasterToken, token)
+}
+
+// Body of POST /tokens; both fields optional
+type tokenRequest struct {
+	// Room ID to bind the token to; a fresh one is picked if empty
+	Room string `json:"room"`
+	// Lifetime as a Go duration, e.g. "48h" (default 24h, at most 30 days)
+	TTL string `json:"ttl"`
+}
+
+// Handle POST /tokens: mint a broadcaster token for a room that may not
+// exist yet
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request) {
+	if !s.isAdmin(r) {
+		http.Error(w, "Admin token required", http.StatusUnauthorized)
+		return
+	}
+	if s.opts.TokenSecret == "" {
+		http.Error(w, "Signed tokens are not enabled on this server", http.StatusNotFound)
+		return
+	}
+
+	var req tokenRequest
+	body := http.MaxBytesReader(w, r.Body, maxOptionsBody)
+	if err := json.NewDecoder(body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Body must be a JSON object", http.StatusBadRequest)
+		return
+	}
+	if req.Room == "" {
+		req.Room = randomHex(6)
+	} else if !validRoomID(req.Room) {
+		http.Error(w, "Invalid room ID", http.StatusBadRequest)
+		return
+	}
+	ttl := defaultTokenTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil || d <= 0 || d > maxTokenTTL {
+			http.Error(w, "ttl must be a positive duration of at most 720h", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+
+	expires := time.Now().Add(ttl)
+	token := s.signToken(broadcasterClaims{Room: req.Room, Exp: expires.Unix()})
+	log.Printf("Broadcaster token issued for room %s, expiring %s", req.Room, expires.UTC().Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{
+		"token":      token,
+		"room":       req.Room,
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,195 @@
+package mixlr
+
+import (
+	"errors"
+	"io"
+	"log"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// A broadcaster can send more than one audio track, e.g. a mic and a music
+// bed. The first goes to the room's main track, exactly as a single-track
+// broadcast does; any others become extra room tracks named after the
+// sender's track ID. Listeners get every track by default and can
+// subscribe/unsubscribe by name, "main" included. When the broadcaster
+// stops sending an extra track, listeners are told
+// {"type":"track_ended","track":name} and the track is removed.
+const mainTrack = "main"
+
+// An extra room track, fanned out like the main one
+type roomTrack struct {
+	local    *webrtc.TrackLocalStaticRTP
+	rewriter rtpRewriter
+	// Broadcaster tracks feeding it; more than one only briefly, when a
+	// track is replaced under the same name. Guarded by room.mu.
+	sources int
+}
+
+// Get or create the extra track called name. A new track is attached to
+// every subscribed listener, who are then renegotiated.
+func (room *Room) extraTrack(name string) (*roomTrack, error) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if rt, ok := room.extraTracks[name]; ok {
+		rt.sources++
+		return rt, nil
+	}
+	local, err := webrtc.NewTrackLocalStaticRTP(opusCapability(room.Stereo), name, room.Name)
+	if err != nil {
+		return nil, err
+	}
+	rt := &roomTrack{local: local, sources: 1}
+	room.extraTracks[name] = rt
+	log.Printf("Room %s has a new track %q", room.Name, name)
+
+	for _, p := range room.Listeners {
+		if !p.unsubscribed[name] && room.attach(p, name) {
+			go p.renegotiate(room)
+		}
+	}
+	return rt, nil
+}
+
+// Attach the named track to a listener. Caller must hold room.mu.
+func (room *Room) attach(p *peer, name string) bool {
+	if p.senders[name] != nil {
+		return false
+	}
+	local := room.mainTrackFor(p)
+	if name != mainTrack {
+		rt, ok := room.extraTracks[name]
+		if !ok {
+			return false
+		}
+		local = rt.local
+	}
+
+	sender, err := p.pc.AddTrack(local)
+	if err != nil {
+		log.Println("AddTrack error:", err)
+		return false
+	}
+	p.senders[name] = sender
+	switch {
+	case name != mainTrack:
+		// The main sender's RTCP feeds bandwidth estimation; extras just drain
+		go drainRTCP(sender)
+	case p.readRTCP != nil:
+		// Resubscribed: the reader started at join ended with the old sender
+		go p.readRTCP(sender)
+	}
+	return true
+}
+
+// Attach every extra track the listener hasn't opted out of, before its
+// first offer. Caller must hold room.mu.
+func (room *Room) attachExtras(p *peer) {
+	for name := range room.extraTracks {
+		if !p.unsubscribed[name] {
+			room.attach(p, name)
+		}
+	}
+}
+
+// Handle {"type":"subscribe"|"unsubscribe","track":name}. Reports whether
+// the listener's tracks changed and need renegotiating.
+func (room *Room) setSubscribed(p *peer, name string, subscribe bool) bool {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	if room.Listeners[p.pc] == nil {
+		return false
+	}
+	if _, ok := room.extraTracks[name]; !ok && name != mainTrack {
+		return false
+	}
+
+	if subscribe {
+		delete(p.unsubscribed, name)
+		return room.attach(p, name)
+	}
+
+	p.unsubscribed[name] = true
+	sender := p.senders[name]
+	if sender == nil {
+		return false
+	}
+	delete(p.senders, name)
+	if err := p.pc.RemoveTrack(sender); err != nil {
+		log.Println("RemoveTrack error:", err)
+		return false
+	}
+	return true
+}
+
+// Forward an extra broadcaster track into its room track
+func (room *Room) forwardExtra(remoteTrack *webrtc.TrackRemote) {
+	rt, err := room.extraTrack(remoteTrack.ID())
+	if err != nil {
+		log.Println("Extra track error:", err)
+		return
+	}
+
+	first := true
+	var in rtpReader
+	for {
+		pkt, err := in.read(remoteTrack)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				room.endExtra(remoteTrack.ID(), rt)
+			}
+			return
+		}
+		if first {
+			rt.rewriter.rebase(pkt, remoteTrack.Codec().ClockRate)
+			first = false
+		}
+		if room.holding() {
+			rt.rewriter.skip()
+			continue
+		}
+		rt.rewriter.rewrite(pkt)
+		room.ingress.add(pkt.MarshalSize())
+		rt.local.WriteRTP(pkt)
+	}
+}
+
+// The broadcaster stopped sending an extra track: detach it from every
+// listener and tell them it's gone
+func (room *Room) endExtra(name string, rt *roomTrack) {
+	room.mu.Lock()
+	rt.sources--
+	if rt.sources > 0 || room.extraTracks[name] != rt {
+		room.mu.Unlock()
+		return
+	}
+	delete(room.extraTracks, name)
+	for _, p := range room.Listeners {
+		sender := p.senders[name]
+		if sender == nil {
+			continue
+		}
+		delete(p.senders, name)
+		if err := p.pc.RemoveTrack(sender); err != nil {
+			log.Println("RemoveTrack error:", err)
+			continue
+		}
+		go p.renegotiate(room)
+	}
+	room.mu.Unlock()
+
+	log.Printf("Room %s track %q ended", room.Name, name)
+	room.broadcast(map[string]string{"type": "track_ended", "track": name})
+}
+
+// Read and discard RTCP so the sender's interceptors keep running
+func drainRTCP(sender *webrtc.RTPSender) {
+	buf := make([]byte, 1500)
+	for {
+		if _, _, err := sender.Read(buf); err != nil {
+			return
+		}
+	}
+}
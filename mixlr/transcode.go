@@ -0,0 +1,140 @@
+package mixlr
+
+import (
+	"github.com/pion/rtp"
+)
+
+// With audio_mode=transcode, the broadcaster's Opus is decoded and encoded
+// afresh before it reaches the room track, so every listener gets the same
+// encoding (opusFrameTicks frames at transcodeBitrate per channel) whatever the
+// broadcaster's client chose. It costs a decode and an encode per frame,
+// which is why passthrough stays the default. Needs a server built with
+// -tags opus (see opus.go).
+
+// Opus always decodes at 48kHz, the RTP clock rate too
+const opusRate = 48000
+
+const (
+	// Samples per channel in the longest packet Opus allows (120ms)
+	opusMaxPacket = opusRate * 120 / 1000
+	// Largest Opus packet worth allowing room for
+	opusMaxBytes = 1275
+
+	transcodeBitrate = 64000
+	// Losses longer than this aren't concealed, just skipped over
+	maxConcealedPackets = 5
+)
+
+// The codec a transcoder drives: opusDecoder and opusEncoder, or stand-ins
+// in tests
+type pcmDecoder interface {
+	decode(packet []byte, pcm []int16) (int, error)
+	close()
+}
+
+type pcmEncoder interface {
+	encode(pcm []int16, out []byte) (int, error)
+	close()
+}
+
+// Decodes one source's packets and re-encodes them as even 20ms frames with
+// sequence numbers and timestamps of its own
+type transcoder struct {
+	channels int
+	dec      pcmDecoder
+	enc      pcmEncoder
+
+	pcm     []int16 // decode buffer
+	pending []int16 // decoded but not yet encoded
+	out     rtp.Packet
+	payload []byte
+
+	started  bool
+	nextIn   uint16 // sequence number expected next from the source
+	lastSize int    // samples per channel in the source's last packet
+}
+
+func newTranscoder(channels int) (*transcoder, error) {
+	dec, err := newOpusDecoder(channels)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := newOpusEncoder(channels, transcodeBitrate*channels)
+	if err != nil {
+		dec.close()
+		return nil, err
+	}
+	return newTranscoderWith(channels, dec, enc), nil
+}
+
+func newTranscoderWith(channels int, dec pcmDecoder, enc pcmEncoder) *transcoder {
+	return &transcoder{
+		channels: channels,
+		dec:      dec,
+		enc:      enc,
+		pcm:      make([]int16, opusMaxPacket*channels),
+		payload:  make([]byte, opusMaxBytes),
+	}
+}
+
+// Feed one source packet, calling emit with each frame that completes. The
+// first output packet carries the source's own sequence number and
+// timestamp, so the room's rewriter rebases it like an untouched one.
+// Emitted packets are reused once emit returns. A packet arriving after
+// later ones is dropped: its place in the stream has gone.
+func (tc *transcoder) process(pkt *rtp.Packet, emit func(*rtp.Packet)) error {
+	ahead := int16(pkt.SequenceNumber - tc.nextIn)
+	if tc.started && ahead < 0 {
+		return nil
+	}
+	if !tc.started {
+		tc.started = true
+		tc.out.Header = rtp.Header{
+			Version:        2,
+			PayloadType:    pkt.PayloadType,
+			SequenceNumber: pkt.SequenceNumber,
+			Timestamp:      pkt.Timestamp,
+			SSRC:           pkt.SSRC,
+		}
+	} else if ahead > 0 && ahead <= maxConcealedPackets && tc.lastSize > 0 {
+		for range ahead {
+			n, err := tc.dec.decode(nil, tc.pcm[:tc.lastSize*tc.channels])
+			if err != nil {
+				break
+			}
+			tc.pending = append(tc.pending, tc.pcm[:n*tc.channels]...)
+		}
+	}
+	tc.nextIn = pkt.SequenceNumber + 1
+
+	n, err := tc.dec.decode(pkt.Payload, tc.pcm)
+	if err != nil {
+		return err
+	}
+	tc.lastSize = n
+	tc.pending = append(tc.pending, tc.pcm[:n*tc.channels]...)
+
+	frame := opusFrameTicks * tc.channels
+	used := 0
+	defer func() {
+		// Keep the remainder at the front so the buffer doesn't creep along
+		tc.pending = tc.pending[:copy(tc.pending, tc.pending[used:])]
+	}()
+	for len(tc.pending)-used >= frame {
+		size, err := tc.enc.encode(tc.pending[used:used+frame], tc.payload)
+		used += frame
+		if err != nil {
+			return err
+		}
+		tc.out.Payload = tc.payload[:size]
+		emit(&tc.out)
+		tc.out.SequenceNumber++
+		tc.out.Timestamp += opusFrameTicks
+	}
+	return nil
+}
+
+func (tc *transcoder) close() {
+	tc.dec.close()
+	tc.enc.close()
+}
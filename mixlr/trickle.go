@@ -0,0 +1,35 @@
+package mixlr
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Rooms created with no_trickle_ice=true, or every room with
+// Options.NoTrickleICE, hold each offer and answer until ICE gathering has
+// finished, so all of the server's candidates are in the SDP and no
+// "candidate" messages are sent. Some SIP and WebRTC gateways only work
+// that way; the cost is a slower setup, by however long gathering takes.
+// The choice is made at join and kept for the life of the connection.
+
+// Longest an offer or answer waits for gathering before going out with
+// the candidates found so far
+const gatherTimeout = 10 * time.Second
+
+// The local description once ICE gathering is done, candidates included.
+// Must be called after SetLocalDescription, which is what starts gathering.
+func gatheredDescription(pc *webrtc.PeerConnection) (webrtc.SessionDescription, error) {
+	select {
+	case <-webrtc.GatheringCompletePromise(pc):
+	case <-time.After(gatherTimeout):
+		log.Printf("ICE gathering still running after %s, sending the candidates so far", gatherTimeout)
+	}
+	desc := pc.LocalDescription()
+	if desc == nil {
+		return webrtc.SessionDescription{}, errors.New("no local description")
+	}
+	return *desc, nil
+}
@@ -0,0 +1,100 @@
+package mixlr
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Check a TURN URL (RFC 7065) up front, rather than have every peer
+// connection fail on it: turn: or turns: (TURN over TLS, usually on 443 to
+// get through firewalls that only pass TLS), a host, an optional port, and
+// an optional transport of udp or tcp.
+func validateTURNURL(raw string) error {
+	scheme, rest, _ := strings.Cut(raw, ":")
+	if scheme != "turn" && scheme != "turns" {
+		return fmt.Errorf("TURN URL %q: scheme must be turn or turns", raw)
+	}
+	hostport, query, _ := strings.Cut(rest, "?")
+	if hostport == "" || strings.HasPrefix(hostport, "//") {
+		return fmt.Errorf("TURN URL %q: want %s:host[:port]", raw, scheme)
+	}
+	if _, port, err := net.SplitHostPort(hostport); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("TURN URL %q: invalid port %q", raw, port)
+		}
+	} else if strings.Contains(hostport, ":") && !strings.HasPrefix(hostport, "[") {
+		return fmt.Errorf("TURN URL %q: %w", raw, err)
+	}
+	if query != "" {
+		transport, ok := strings.CutPrefix(query, "transport=")
+		if !ok || (transport != "udp" && transport != "tcp") {
+			return fmt.Errorf("TURN URL %q: only transport=udp or transport=tcp is supported", raw)
+		}
+	}
+	return nil
+}
+
+// ICE servers for a new peer connection. With TURN configured, each call
+// mints fresh credentials using the TURN REST API scheme: the username is
+// "<expiry unix time>:<name>" and the credential is
+// base64(HMAC-SHA1(secret, username)), which coturn's use-auth-secret checks.
+func (s *Server) iceServers() []webrtc.ICEServer {
+	// Host candidates only: asked for explicitly, or as an ICE-lite server,
+	// which has no use for STUN or TURN (and pion refuses them)
+	if s.opts.ICELite || s.opts.NoSTUN {
+		return nil
+	}
+	servers := []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.l.google.com:19302"}},
+	}
+	secret := *s.turnSecret.Load()
+	if len(s.opts.TURNURLs) == 0 || secret == "" {
+		return servers
+	}
+
+	username := fmt.Sprintf("%d:mixlr", time.Now().Add(s.opts.TURNTTL).Unix())
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+
+	return append(servers, webrtc.ICEServer{
+		URLs:       s.opts.TURNURLs,
+		Username:   username,
+		Credential: base64.StdEncoding.EncodeToString(mac.Sum(nil)),
+	})
+}
+
+// Swap the TURN secret, e.g. when the TURN server's is rotated. Running
+// connections are left alone; credentials minted from now on, for new
+// peers and for ICE restarts, use the new secret.
+func (s *Server) SetTURNSecret(secret string) {
+	s.turnSecret.Store(&secret)
+	log.Println("TURN secret rotated")
+}
+
+// Handle {"type":"ice_restart"}: the client is about to restart ICE, say
+// after a network change hours into a broadcast, and its TURN credentials
+// may have expired or been minted from a secret since rotated. It's sent
+// {"type":"ice_servers","ice_servers":[...]} with fresh ones to restart
+// with. Broadcasters then send an ICE-restart offer of their own; listeners
+// are sent one. The server's own side keeps the candidates it gathered at
+// join, as pion's agent keeps the servers it was created with.
+func (s *Server) restartICE(p *peer, room *Room) {
+	p.ws.WriteJSON(map[string]any{"type": "ice_servers", "ice_servers": s.iceServers()})
+	if p.role == roleBroadcaster {
+		return
+	}
+	var err error
+	s.negotiate(func() { err = p.offerWith(room, true) })
+	if err != nil {
+		log.Println("ICE restart offer error:", err)
+	}
+}
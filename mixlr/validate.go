@@ -0,0 +1,127 @@
+package mixlr
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Minimum length of Options.TokenSecret, as it's an HMAC key
+const minTokenSecretLen = 16
+
+// Check the options for values that could only fail later, at the first
+// connection or room that uses them. Every problem is reported, not just
+// the first. NewServer runs this; call it directly to vet a configuration
+// without starting anything.
+func (o Options) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	for _, f := range []struct {
+		name string
+		n    int
+	}{
+		{"renegotiation limit", o.RenegotiationLimit},
+		{"max room bandwidth", o.MaxRoomBandwidth},
+		{"max broadcast bitrate", o.MaxBroadcastBitrate},
+		{"max listeners per IP", o.MaxListenersPerIP},
+		{"message rate", o.MessageRate},
+		{"message burst", o.MessageBurst},
+		{"PC create retries", o.PCCreateRetries},
+		{"max negotiations", o.MaxNegotiations},
+		{"fanout workers", o.FanoutWorkers},
+		{"fanout threshold", o.FanoutThreshold},
+		{"max connections", o.MaxConnections},
+		{"max goroutines", o.MaxGoroutines},
+		{"max rooms per user", o.MaxRoomsPerUser},
+		{"max lobby rooms", o.MaxLobbyRooms},
+		{"prime packets", o.PrimePackets},
+		{"preconnect buffer", o.PreconnectBuffer},
+	} {
+		check(f.n >= 0, "%s %d must not be negative", f.name, f.n)
+	}
+	for _, f := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"renegotiation window", o.RenegotiationWindow},
+		{"TURN TTL", o.TURNTTL},
+		{"recording grace", o.RecordingGrace},
+		{"PC create retry delay", o.PCCreateRetryDelay},
+		{"reattach window", o.ReattachWindow},
+		{"idempotency TTL", o.IdempotencyTTL},
+		{"handshake timeout", o.HandshakeTimeout},
+		{"peer close timeout", o.PeerCloseTimeout},
+		{"first track timeout", o.FirstTrackTimeout},
+		{"pacing gap", o.PacingGap},
+		{"reservation window", o.ReservationWindow},
+		{"room idle timeout", o.RoomIdleTimeout},
+	} {
+		check(f.d >= 0, "%s %s must not be negative", f.name, f.d)
+	}
+
+	check(o.MaxRoomsPerUser <= 0 || o.RoomIdleTimeout > 0,
+		"max rooms per user needs a room idle timeout, or rooms never count off the quota")
+
+	for _, n := range o.ListenerMilestones {
+		check(n > 0, "listener milestone %d must be positive", n)
+	}
+
+	check(o.MaxBroadcastBitrate <= 0 || o.MaxBroadcastBitrate >= minBroadcasterBitrate,
+		"max broadcaster bitrate %d is below the %d bits/s Opus minimum", o.MaxBroadcastBitrate, minBroadcasterBitrate)
+	if _, err := opusPayloadType(o.OpusPayloadType); err != nil {
+		errs = append(errs, err)
+	}
+	switch o.DuplicateListeners {
+	case "", DuplicateListenerReject, DuplicateListenerReplace:
+	default:
+		errs = append(errs, fmt.Errorf("duplicate listener policy %q must be %q or %q",
+			o.DuplicateListeners, DuplicateListenerReject, DuplicateListenerReplace))
+	}
+	if _, err := dtlsRole(o.DTLSRole); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, u := range o.TURNURLs {
+		if err := validateTURNURL(u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	check(len(o.TURNURLs) == 0 || o.TURNSecret != "", "TURN URLs are set but TURN secret is empty")
+
+	check(o.TokenSecret == "" || len(o.TokenSecret) >= minTokenSecretLen,
+		"token secret must be at least %d characters", minTokenSecretLen)
+
+	if o.RegionURL != "" {
+		u, err := url.Parse(o.RegionURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"region URL %q must be an http(s) URL", o.RegionURL)
+	}
+	if o.RootRedirect != "" {
+		_, err := url.Parse(o.RootRedirect)
+		check(err == nil, "invalid root redirect %q", o.RootRedirect)
+	}
+
+	// Created on demand, but whatever's already there has to be usable
+	if o.RecordingDir != "" {
+		info, err := os.Stat(o.RecordingDir)
+		check(err != nil || info.IsDir(), "recording dir %s is not a directory", o.RecordingDir)
+	}
+	if o.DTLSCertFile != "" {
+		info, err := os.Stat(filepath.Dir(o.DTLSCertFile))
+		check(err == nil && info.IsDir(), "DTLS certificate directory %s does not exist", filepath.Dir(o.DTLSCertFile))
+	}
+	if o.SeedFile != "" {
+		_, err := os.Stat(o.SeedFile)
+		check(err == nil, "rooms seed file: %v", err)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,89 @@
+package mixlr
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Delivery attempts per webhook event, and the wait before the first retry
+// (doubled each time)
+const (
+	webhookAttempts   = 3
+	webhookRetryDelay = time.Second
+)
+
+var webhookClient = outboundClient(5 * time.Second)
+
+// Listener counts that fire a listener_milestone event on the way up,
+// unless Options.ListenerMilestones says otherwise
+var defaultListenerMilestones = []int{1, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// Per-room lifecycle webhook. Each event is POSTed as JSON from its own
+// goroutine, so a slow endpoint never holds up signaling or media. With a
+// secret, the body is signed as X-Mixlr-Signature: sha256=<hex HMAC>.
+// Like icecast_url, the URL is limited to admins or Options.OutboundHosts
+// (see outbound.go).
+type webhook struct {
+	url    string
+	secret string
+}
+
+func (wh *webhook) send(ev roomEvent) {
+	if wh == nil {
+		return
+	}
+	if ev.Time == "" {
+		ev.Time = time.Now().UTC().Format(time.RFC3339)
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	go wh.deliver(ev, body)
+}
+
+func (wh *webhook) deliver(ev roomEvent, body []byte) {
+	defer recoverPanic("webhook for room "+ev.Room, nil)
+	delay := webhookRetryDelay
+	var err error
+	for attempt := 1; attempt <= webhookAttempts; attempt++ {
+		if err = wh.post(body); err == nil {
+			return
+		}
+		if attempt < webhookAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	log.Printf("Webhook %s for room %s failed: %v", ev.Type, ev.Room, err)
+}
+
+func (wh *webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.secret != "" {
+		mac := hmac.New(sha256.New, []byte(wh.secret))
+		mac.Write(body)
+		req.Header.Set("X-Mixlr-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return nil
+}